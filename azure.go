@@ -0,0 +1,1081 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/comfforts/errors"
+	"github.com/comfforts/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	AZURE_SCHEME                   = "azblob"
+	AZURE_API_VERSION              = "2021-08-06"
+	DEFAULT_AZURE_BLOCK_SIZE int64 = 8 * 1024 * 1024
+	azureMetaHeaderPrefix          = "X-Ms-Meta-"
+	azureCopyPollInterval          = 200 * time.Millisecond
+)
+
+func init() {
+	// azblob://account for Azure storage account,
+	// azblob://host:port/account for emulator or custom endpoint, with insecure query param for plain http endpoint
+	RegisterBackend(AZURE_SCHEME, func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		if err := rejectGCSOnlyConfig(cfg, logger); err != nil {
+			return nil, err
+		}
+		azCfg := AzureClientConfig{
+			AccountName: storageURL.Host,
+		}
+		if account := strings.Trim(storageURL.Path, "/"); account != "" {
+			scheme := "https"
+			if insecure, _ := strconv.ParseBool(storageURL.Query().Get("insecure")); insecure {
+				scheme = "http"
+			}
+			azCfg.AccountName = account
+			azCfg.Endpoint = scheme + "://" + storageURL.Host + "/" + account
+		}
+		return NewAzureStorageClient(azCfg, logger)
+	})
+}
+
+// AzureClientConfig configures Azure Blob storage client
+type AzureClientConfig struct {
+	// Endpoint is blob service URL, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite,
+	// https://<account>.blob.core.windows.net when empty
+	Endpoint string `json:"endpoint"`
+	// AccountName is storage account name, from AZURE_STORAGE_ACCOUNT when empty
+	AccountName string `json:"account_name"`
+	// AccountKey is base64 encoded shared key, from AZURE_STORAGE_KEY when empty
+	AccountKey string `json:"account_key"`
+	// SASToken is shared access signature query, from AZURE_STORAGE_SAS_TOKEN when empty,
+	// used when account key is not set
+	SASToken string `json:"sas_token"`
+	// BlockSize is block size for staged uploads, uploads larger than block size are staged in blocks
+	BlockSize  int64        `json:"block_size"`
+	HTTPClient *http.Client `json:"-"`
+}
+
+type azureStorageClient struct {
+	config   AzureClientConfig
+	endpoint *url.URL
+	key      []byte
+	client   *http.Client
+	logger   logger.AppLogger
+}
+
+// NewAzureStorageClient takes Azure client config & logger, returns Azure Blob storage client,
+// containers are buckets & block blobs are objects
+func NewAzureStorageClient(cfg AzureClientConfig, logger logger.AppLogger) (*azureStorageClient, error) {
+	if logger == nil {
+		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+
+	if cfg.AccountName == "" {
+		cfg.AccountName = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if cfg.AccountName == "" {
+		logger.Error(ERROR_MISSING_AZURE_ACCOUNT)
+		return nil, ErrAzureAccountMissing
+	}
+	if cfg.AccountKey == "" && cfg.SASToken == "" {
+		cfg.AccountKey = os.Getenv("AZURE_STORAGE_KEY")
+		cfg.SASToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	cfg.SASToken = strings.TrimPrefix(cfg.SASToken, "?")
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.AccountName)
+	}
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = DEFAULT_AZURE_BLOCK_SIZE
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.String("endpoint", cfg.Endpoint))
+		return nil, ErrInvalidStorageURL
+	}
+
+	var key []byte
+	if cfg.AccountKey != "" {
+		key, err = base64.StdEncoding.DecodeString(cfg.AccountKey)
+		if err != nil {
+			logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err))
+			return nil, wrapStorageError(err, ERROR_CREATING_STORAGE_CLIENT)
+		}
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &azureStorageClient{
+		config:   cfg,
+		endpoint: endpoint,
+		key:      key,
+		client:   client,
+		logger:   logger,
+	}, nil
+}
+
+// blobURL returns URL for container blob, container URL when blob name is empty
+func (ac *azureStorageClient) blobURL(container, name string, query url.Values) *url.URL {
+	u := *ac.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/" + container
+	if name != "" {
+		p = p + "/" + name
+	}
+	u.Path = p
+	u.RawPath = escapePath(p)
+
+	// SAS token authorizes requests when there is no shared key
+	rawQuery := query.Encode()
+	if ac.key == nil && ac.config.SASToken != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += ac.config.SASToken
+	}
+	u.RawQuery = rawQuery
+	return &u
+}
+
+// do sends authorized request for container blob, returns response or, for error status, response error
+func (ac *azureStorageClient) do(ctx context.Context, method, container, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, ac.blobURL(container, name, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("X-Ms-Version", AZURE_API_VERSION)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if ac.key != nil {
+		signature := azureSharedKeySignature(req, ac.config.AccountName, ac.key)
+		req.Header.Set("Authorization", "SharedKey "+ac.config.AccountName+":"+signature)
+	}
+
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		return nil, azureResponseError(resp)
+	}
+	return resp, nil
+}
+
+// azureSharedKeySignature returns shared key signature of blob service request
+func azureSharedKeySignature(req *http.Request, account string, key []byte) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	// canonicalized x-ms- headers
+	msHeaders := []string{}
+	for name, values := range req.Header {
+		lName := strings.ToLower(name)
+		if strings.HasPrefix(lName, "x-ms-") {
+			msHeaders = append(msHeaders, lName+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	// canonicalized resource
+	resource := strings.Builder{}
+	resource.WriteString("/" + account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // date, x-ms-date is set
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource.String(),
+	}, "\n")
+
+	return base64.StdEncoding.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// azureErrorResponse is blob service error response body
+type azureErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// azureResponseError returns response error for blob service error response
+func azureResponseError(resp *http.Response) error {
+	rErr := &responseError{
+		StatusCode: resp.StatusCode,
+		Code:       resp.Header.Get("X-Ms-Error-Code"),
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	errResp := azureErrorResponse{}
+	if len(data) > 0 && xml.Unmarshal(data, &errResp) == nil {
+		rErr.Code = errResp.Code
+		rErr.Message = errResp.Message
+	}
+	if rErr.Code == "" {
+		rErr.Code = http.StatusText(resp.StatusCode)
+	}
+	return rErr
+}
+
+// azureBlobInfo takes container, blob name & blob response header, returns object info
+func azureBlobInfo(container, name string, header http.Header) ObjectInfo {
+	etag := header.Get("ETag")
+	updated, _ := http.ParseTime(header.Get("Last-Modified"))
+	created, err := http.ParseTime(header.Get("X-Ms-Creation-Time"))
+	if err != nil {
+		created = updated
+	}
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	md5Sum, _ := base64.StdEncoding.DecodeString(header.Get("Content-MD5"))
+	info := ObjectInfo{
+		Bucket:          container,
+		Name:            name,
+		Size:            size,
+		ContentType:     header.Get("Content-Type"),
+		ContentEncoding: header.Get("Content-Encoding"),
+		Generation:      etagGeneration(etag),
+		Metageneration:  1,
+		StorageClass:    header.Get("X-Ms-Access-Tier"),
+		ETag:            etag,
+		Created:         created,
+		Updated:         updated,
+	}
+	if len(md5Sum) > 0 {
+		info.MD5 = md5Sum
+	}
+	for hName, values := range header {
+		if strings.HasPrefix(hName, azureMetaHeaderPrefix) && len(values) > 0 {
+			if info.Metadata == nil {
+				info.Metadata = map[string]string{}
+			}
+			info.Metadata[strings.ToLower(hName[len(azureMetaHeaderPrefix):])] = values[0]
+		}
+	}
+	return info
+}
+
+// blobProperties returns blob info, object not found error if blob doesn't exist
+func (ac *azureStorageClient) blobProperties(ctx context.Context, container, name string) (ObjectInfo, error) {
+	resp, err := ac.do(ctx, http.MethodHead, container, name, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, wrapStorageError(err, "azure file inaccessible %s", name)
+	}
+	resp.Body.Close()
+	return azureBlobInfo(container, name, resp.Header), nil
+}
+
+// pinnedBlob returns info of blob pinned to request generation, stale download error if blob was replaced
+func (ac *azureStorageClient) pinnedBlob(ctx context.Context, container, name string, gen int64) (ObjectInfo, error) {
+	info, err := ac.blobProperties(ctx, container, name)
+	if err != nil {
+		if gen > 0 && isKind(err, ErrObjectNotFound) {
+			return ObjectInfo{}, kindError(ErrStaleDownload, err)
+		}
+		return ObjectInfo{}, err
+	}
+	if gen > 0 && info.Generation != gen {
+		return ObjectInfo{}, kindError(ErrStaleDownload, nil)
+	}
+	return info, nil
+}
+
+// currentBlob returns blob info, nil if blob doesn't exist
+func (ac *azureStorageClient) currentBlob(ctx context.Context, container, name string) (*ObjectInfo, error) {
+	info, err := ac.blobProperties(ctx, container, name)
+	if err != nil {
+		if isKind(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &info, nil
+}
+
+// azureWriteHeader returns blob attribute headers for request, starting from given base attributes
+func azureWriteHeader(cfr CloudFileRequest, base *ObjectInfo) http.Header {
+	header := http.Header{}
+	info := ObjectInfo{}
+	if base != nil {
+		info = *base
+	}
+	if cfr.contentType != "" {
+		info.ContentType = cfr.contentType
+	}
+	if cfr.storageClass != "" {
+		info.StorageClass = cfr.storageClass
+	}
+	if cfr.metadata != nil {
+		info.Metadata = cfr.metadata
+	}
+
+	if info.ContentType != "" {
+		header.Set("X-Ms-Blob-Content-Type", info.ContentType)
+	}
+	if info.ContentEncoding != "" {
+		header.Set("X-Ms-Blob-Content-Encoding", info.ContentEncoding)
+	}
+	if info.StorageClass != "" {
+		header.Set("X-Ms-Access-Tier", info.StorageClass)
+	}
+	for k, v := range info.Metadata {
+		header.Set(azureMetaHeaderPrefix+k, v)
+	}
+	return header
+}
+
+// UploadFile uploads file as a block blob in one request,
+// or staged in blocks when larger than configured block size
+func (ac *azureStorageClient) UploadFile(ctx context.Context, file io.Reader, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	name := cfr.objectName()
+
+	var current *ObjectInfo
+	if cfr.isConditional() {
+		info, err := ac.currentBlob(ctx, cfr.bucket, name)
+		if err != nil {
+			ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", name))
+			return 0, err
+		}
+		current = info
+	}
+
+	// guard against replacing newer or concurrently updated blobs
+	conds, err := writeConditionHeaders(cfr, current)
+	if err != nil {
+		ac.logger.Error(ERROR_STALE_UPLOAD, zap.String("filepath", name), zap.Int64("modTime", cfr.modTime), zap.Int64("generation", cfr.generation))
+		return 0, err
+	}
+
+	// files smaller than block size are uploaded in one request
+	first := bytes.Buffer{}
+	n, err := io.CopyN(&first, file, ac.config.BlockSize)
+	if err != nil && err != io.EOF {
+		ac.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", name))
+		return 0, wrapStorageError(err, "error uploading file %s", name)
+	}
+	header := azureWriteHeader(cfr, nil)
+	// sniff content type like cloud uploads do
+	if header.Get("X-Ms-Blob-Content-Type") == "" {
+		header.Set("X-Ms-Blob-Content-Type", http.DetectContentType(first.Bytes()))
+	}
+	for hName, values := range conds {
+		header[hName] = values
+	}
+
+	var nBytes int64
+	if n < ac.config.BlockSize {
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+		resp, pErr := ac.do(ctx, http.MethodPut, cfr.bucket, name, nil, header, first.Bytes())
+		if pErr == nil {
+			resp.Body.Close()
+		}
+		nBytes, err = n, pErr
+	} else {
+		nBytes, err = ac.stageBlocks(ctx, cfr.bucket, name, header, first.Bytes(), file)
+	}
+	if err != nil {
+		if isWriteConflict(err) {
+			ac.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("filepath", name))
+			return 0, kindError(ErrStaleUpload, err)
+		}
+		ac.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", name))
+		return 0, wrapStorageError(err, "error uploading file %s", name)
+	}
+	ac.logger.Debug("azure file created/updated", zap.String("filepath", name), zap.Int64("size", nBytes))
+	return nBytes, nil
+}
+
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+// stageBlocks stages given full first block & rest of reader in blocks, reusing first block buffer,
+// & commits block list with given blob headers & write conditions.
+// Blocks of failed uploads stay uncommitted & are garbage collected by the service
+func (ac *azureStorageClient) stageBlocks(ctx context.Context, container, name string, header http.Header, buf []byte, r io.Reader) (int64, error) {
+	// concurrent uploads of a blob stage blocks in the same uncommitted block list,
+	// block ids are prefixed with upload id so uploads never commit each other's blocks
+	uploadID := make([]byte, 8)
+	if _, err := rand.Read(uploadID); err != nil {
+		return 0, err
+	}
+
+	blockList := azureBlockList{}
+	var nBytes int64
+	n := len(buf)
+	for blockNum := 0; n > 0; blockNum++ {
+		// block ids of a blob must have equal length
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%x-%08d", uploadID, blockNum)))
+		query := url.Values{
+			"comp":    {"block"},
+			"blockid": {blockID},
+		}
+		resp, err := ac.do(ctx, http.MethodPut, container, name, query, nil, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		blockList.Latest = append(blockList.Latest, blockID)
+		nBytes += int64(n)
+		ac.logger.Debug("staged azure file block", zap.String("filepath", name), zap.Int("block", blockNum), zap.Int("size", n))
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+	}
+
+	body, err := xml.Marshal(blockList)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ac.do(ctx, http.MethodPut, container, name, url.Values{"comp": {"blocklist"}}, header, body)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return nBytes, nil
+}
+
+func (ac *azureStorageClient) DownloadFile(ctx context.Context, file io.Writer, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	name := cfr.objectName()
+
+	header := http.Header{}
+	if cfr.generation > 0 {
+		info, err := ac.pinnedBlob(ctx, cfr.bucket, name, cfr.generation)
+		if err != nil {
+			ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", name))
+			return 0, err
+		}
+		header.Set("If-Match", info.ETag)
+	}
+
+	resp, err := ac.do(ctx, http.MethodGet, cfr.bucket, name, nil, header, nil)
+	if err != nil {
+		if cfr.generation > 0 && (isPreconditionFailed(err) || hasStatus(err, http.StatusNotFound)) {
+			ac.logger.Error(ERROR_STALE_DOWNLOAD, zap.Error(err), zap.String("filepath", name))
+			return 0, kindError(ErrStaleDownload, err)
+		}
+		ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", name))
+		return 0, wrapStorageError(err, "azure file inaccessible %s", name)
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(file, resp.Body)
+	if err != nil {
+		ac.logger.Error("error copying azure file", zap.Error(err), zap.String("filepath", name))
+		return n, wrapStorageError(err, "error copying cloud file %s", name)
+	}
+	return n, nil
+}
+
+// rangeReader returns range reader func for blob, reads are pinned to given entity tag when set
+func (ac *azureStorageClient) rangeReader(container, name, etag string) rangeReaderFunc {
+	return func(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+		header := http.Header{}
+		if length < 0 {
+			header.Set("X-Ms-Range", fmt.Sprintf("bytes=%d-", off))
+		} else {
+			header.Set("X-Ms-Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+		}
+		if etag != "" {
+			header.Set("If-Match", etag)
+		}
+
+		resp, err := ac.do(ctx, http.MethodGet, container, name, nil, header, nil)
+		if err != nil {
+			if isRangeNotSatisfiable(err) {
+				return nil, io.EOF
+			}
+			// pinned blob replaced or removed
+			if etag != "" && (isPreconditionFailed(err) || hasStatus(err, http.StatusNotFound)) {
+				return nil, kindError(ErrStaleDownload, err)
+			}
+			return nil, wrapStorageError(err, "error reading cloud file %s", name)
+		}
+		return resp.Body, nil
+	}
+}
+
+func (ac *azureStorageClient) ReadAt(ctx context.Context, cfr CloudFileRequest, p []byte, off int64) (int, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	name := cfr.objectName()
+	cfr, err := cfr.pinReads(ctx, ac.StatObject)
+	if err != nil {
+		return 0, err
+	}
+
+	// etag of pinned generation is known once request pinned it
+	etag := cfr.pinnedETag()
+	if cfr.generation > 0 && etag == "" {
+		info, err := ac.pinnedBlob(ctx, cfr.bucket, name, cfr.generation)
+		if err != nil {
+			ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", name))
+			return 0, err
+		}
+		etag = info.ETag
+	}
+
+	co := newCloudObject(ctx, name, -1, cfr.generation, ac.rangeReader(cfr.bucket, name, etag))
+	return co.ReadAt(p, off)
+}
+
+func (ac *azureStorageClient) StatObject(ctx context.Context, cfr CloudFileRequest) (ObjectInfo, error) {
+	if cfr.bucket == "" {
+		return ObjectInfo{}, ErrBucketNameMissing
+	}
+	if cfr.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+	return ac.blobProperties(ctx, cfr.bucket, cfr.objectName())
+}
+
+func (ac *azureStorageClient) OpenObject(ctx context.Context, cfr CloudFileRequest) (CloudObject, error) {
+	if cfr.file == "" {
+		return nil, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return nil, ErrBucketNameMissing
+	}
+	name := cfr.objectName()
+
+	info, err := ac.pinnedBlob(ctx, cfr.bucket, name, cfr.generation)
+	if err != nil {
+		ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", name))
+		return nil, err
+	}
+
+	// pin all reads through the handle to opened blob entity tag
+	return newCloudObject(ctx, name, info.Size, info.Generation, ac.rangeReader(cfr.bucket, name, info.ETag)), nil
+}
+
+type azureMetadata struct {
+	Items []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+type azureEnumerationResults struct {
+	NextMarker string `xml:"NextMarker"`
+	Blobs      struct {
+		Blob []struct {
+			Name       string `xml:"Name"`
+			Properties struct {
+				CreationTime    string `xml:"Creation-Time"`
+				LastModified    string `xml:"Last-Modified"`
+				Etag            string `xml:"Etag"`
+				ContentLength   int64  `xml:"Content-Length"`
+				ContentType     string `xml:"Content-Type"`
+				ContentEncoding string `xml:"Content-Encoding"`
+				ContentMD5      string `xml:"Content-MD5"`
+				AccessTier      string `xml:"AccessTier"`
+			} `xml:"Properties"`
+			Metadata azureMetadata `xml:"Metadata"`
+		} `xml:"Blob"`
+		BlobPrefix []struct {
+			Name string `xml:"Name"`
+		} `xml:"BlobPrefix"`
+	} `xml:"Blobs"`
+}
+
+// azureListReached reports whether listed blobs or prefixes reach given end offset, false if there is none
+func azureListReached(result azureEnumerationResults, endOffset string) bool {
+	if endOffset == "" {
+		return false
+	}
+	if n := len(result.Blobs.Blob); n > 0 && result.Blobs.Blob[n-1].Name >= endOffset {
+		return true
+	}
+	if n := len(result.Blobs.BlobPrefix); n > 0 && result.Blobs.BlobPrefix[n-1].Name >= endOffset {
+		return true
+	}
+	return false
+}
+
+// listPage lists one page of request blobs, service default page size when max results is 0
+func (ac *azureStorageClient) listPage(ctx context.Context, req CloudFileRequest, maxResults int, marker string) (ObjectList, error) {
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+		"include": {"metadata"},
+	}
+	if prefix := req.listPrefix(); prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if req.delimiter != "" {
+		query.Set("delimiter", req.delimiter)
+	}
+	if maxResults > 0 {
+		query.Set("maxresults", strconv.Itoa(maxResults))
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+
+	resp, err := ac.do(ctx, http.MethodGet, req.bucket, "", query, nil, nil)
+	if err != nil {
+		return ObjectList{}, wrapStorageError(err, ERROR_LISTING_OBJECTS)
+	}
+	defer resp.Body.Close()
+	result := azureEnumerationResults{}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ObjectList{}, wrapStorageError(err, ERROR_DECODING_RESPONSE)
+	}
+
+	// offsets & glob filter apply after paging, a page may hold fewer than page size objects
+	list := ObjectList{
+		Objects:  []ObjectInfo{},
+		Prefixes: []string{},
+	}
+	// blobs are listed in order, no later page holds blobs before end offset
+	if !azureListReached(result, req.endOffset) {
+		list.NextPageToken = result.NextMarker
+	}
+	for _, prefix := range result.Blobs.BlobPrefix {
+		list.Prefixes = append(list.Prefixes, prefix.Name)
+	}
+	for _, blob := range result.Blobs.Blob {
+		if req.startOffset != "" && blob.Name < req.startOffset {
+			continue
+		}
+		if req.endOffset != "" && blob.Name >= req.endOffset {
+			continue
+		}
+		if !req.matchGlob(blob.Name) {
+			continue
+		}
+		props := blob.Properties
+		updated, _ := http.ParseTime(props.LastModified)
+		created, err := http.ParseTime(props.CreationTime)
+		if err != nil {
+			created = updated
+		}
+		info := ObjectInfo{
+			Bucket:          req.bucket,
+			Name:            blob.Name,
+			Size:            props.ContentLength,
+			ContentType:     props.ContentType,
+			ContentEncoding: props.ContentEncoding,
+			Generation:      etagGeneration(props.Etag),
+			Metageneration:  1,
+			StorageClass:    props.AccessTier,
+			ETag:            props.Etag,
+			Created:         created,
+			Updated:         updated,
+		}
+		if md5Sum, err := base64.StdEncoding.DecodeString(props.ContentMD5); err == nil && len(md5Sum) > 0 {
+			info.MD5 = md5Sum
+		}
+		for _, item := range blob.Metadata.Items {
+			if info.Metadata == nil {
+				info.Metadata = map[string]string{}
+			}
+			info.Metadata[strings.ToLower(item.XMLName.Local)] = item.Value
+		}
+		list.Objects = append(list.Objects, info)
+	}
+	return list, nil
+}
+
+func (ac *azureStorageClient) ListObjects(ctx context.Context, req CloudFileRequest) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+
+	list := ObjectList{
+		Objects:  []ObjectInfo{},
+		Prefixes: []string{},
+	}
+	marker := ""
+	for {
+		page, err := ac.listPage(ctx, req, 0, marker)
+		if err != nil {
+			ac.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+			return list, err
+		}
+		list.Objects = append(list.Objects, page.Objects...)
+		list.Prefixes = append(list.Prefixes, page.Prefixes...)
+		if page.NextPageToken == "" {
+			return list, nil
+		}
+		marker = page.NextPageToken
+	}
+}
+
+// ListObjectsPage takes page size & page token, empty for first page, returns one page of listing
+func (ac *azureStorageClient) ListObjectsPage(ctx context.Context, req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	if pageSize <= 0 {
+		return ObjectList{}, ErrInvalidPageSize
+	}
+
+	list, err := ac.listPage(ctx, req, pageSize, pageToken)
+	if err != nil {
+		ac.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()), zap.String("pageToken", pageToken))
+		return ObjectList{}, err
+	}
+	return list, nil
+}
+
+// StreamObjects streams list entries page by page, channel is closed when listing ends,
+// on listing error, after sending error entry, or on context cancellation
+func (ac *azureStorageClient) StreamObjects(ctx context.Context, req CloudFileRequest) <-chan ListEntry {
+	entryStream := make(chan ListEntry)
+
+	go func() {
+		defer close(entryStream)
+
+		if err := req.validateList(); err != nil {
+			sendListEntry(ctx, entryStream, ListEntry{Err: err})
+			return
+		}
+
+		marker := ""
+		for {
+			page, err := ac.listPage(ctx, req, 0, marker)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				ac.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+				sendListEntry(ctx, entryStream, ListEntry{Err: err})
+				return
+			}
+			for _, prefix := range page.Prefixes {
+				if !sendListEntry(ctx, entryStream, ListEntry{Prefix: prefix}) {
+					return
+				}
+			}
+			for i := range page.Objects {
+				if !sendListEntry(ctx, entryStream, ListEntry{Object: &page.Objects[i]}) {
+					return
+				}
+			}
+			if page.NextPageToken == "" {
+				return
+			}
+			marker = page.NextPageToken
+		}
+	}()
+
+	return entryStream
+}
+
+func (ac *azureStorageClient) CopyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	info, _, err := ac.copyObject(ctx, src, dst)
+	return info, err
+}
+
+func (ac *azureStorageClient) MoveObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	info, srcInfo, err := ac.copyObject(ctx, src, dst)
+	if err != nil {
+		return info, err
+	}
+
+	// move onto itself rewrites attributes only
+	srcName := src.objectName()
+	if src.bucket == dst.bucket && srcName == info.Name {
+		return info, nil
+	}
+
+	// delete only copied source blob
+	resp, err := ac.do(ctx, http.MethodDelete, src.bucket, srcName, nil, http.Header{"If-Match": {srcInfo.ETag}}, nil)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			ac.logger.Error(ERROR_STALE_DOWNLOAD, zap.Error(err), zap.String("src", srcName))
+			ac.rollbackCopy(ctx, info)
+			return ObjectInfo{}, kindError(ErrStaleDownload, err)
+		}
+		ac.logger.Error(ERROR_MOVING_OBJECT, zap.Error(err), zap.String("src", srcName))
+		return info, wrapStorageError(err, ERROR_MOVING_OBJECT)
+	}
+	resp.Body.Close()
+	ac.logger.Debug("moved azure file", zap.String("src", srcName), zap.String("dst", info.Name))
+	return info, nil
+}
+
+// rollbackCopy deletes copied destination blob of a failed move, leaving replaced destinations alone
+func (ac *azureStorageClient) rollbackCopy(ctx context.Context, info ObjectInfo) {
+	resp, err := ac.do(ctx, http.MethodDelete, info.Bucket, info.Name, nil, http.Header{"If-Match": {info.ETag}}, nil)
+	if err != nil {
+		ac.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("dst", info.Name))
+		return
+	}
+	resp.Body.Close()
+}
+
+// copyObject copies source to destination server side, pinned to source entity tag at copy start,
+// waits for pending copies, returns destination & copied source blob info
+func (ac *azureStorageClient) copyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, ObjectInfo, error) {
+	if src.bucket == "" || dst.bucket == "" {
+		return ObjectInfo{}, ObjectInfo{}, ErrBucketNameMissing
+	}
+	if src.file == "" || dst.file == "" {
+		return ObjectInfo{}, ObjectInfo{}, ErrFileNameMissing
+	}
+	srcName, dstName := src.objectName(), dst.objectName()
+
+	srcInfo, err := ac.pinnedBlob(ctx, src.bucket, srcName, src.generation)
+	if err != nil {
+		ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", srcName))
+		return ObjectInfo{}, ObjectInfo{}, err
+	}
+
+	// destination preconditions, modification time applies to uploads only
+	dst.modTime = 0
+	var current *ObjectInfo
+	if dst.isConditional() {
+		current, err = ac.currentBlob(ctx, dst.bucket, dstName)
+		if err != nil {
+			ac.logger.Error("azure file inaccessible", zap.Error(err), zap.String("filepath", dstName))
+			return ObjectInfo{}, ObjectInfo{}, err
+		}
+	}
+	header, err := writeConditionHeaders(dst, current)
+	if err != nil {
+		ac.logger.Error(ERROR_STALE_UPLOAD, zap.String("src", srcName), zap.String("dst", dstName))
+		return ObjectInfo{}, ObjectInfo{}, err
+	}
+
+	// copy keeps source properties & metadata, unless metadata is overridden
+	if dst.metadata != nil {
+		for k, v := range dst.metadata {
+			header.Set(azureMetaHeaderPrefix+k, v)
+		}
+	}
+	if dst.storageClass != "" {
+		header.Set("X-Ms-Access-Tier", dst.storageClass)
+	}
+	header.Set("X-Ms-Copy-Source", ac.blobURL(src.bucket, srcName, nil).String())
+	header.Set("X-Ms-Source-If-Match", srcInfo.ETag)
+
+	errMsg := ERROR_COPYING_OBJECT
+	resp, err := ac.do(ctx, http.MethodPut, dst.bucket, dstName, nil, header, nil)
+	if err == nil {
+		resp.Body.Close()
+		err = ac.waitForCopy(ctx, dst.bucket, dstName, resp.Header)
+	}
+	if err == nil && dst.contentType != "" {
+		err = ac.setContentType(ctx, dst.bucket, dstName, dst.contentType)
+	}
+	if err != nil {
+		if isWriteConflict(err) {
+			ac.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+			return ObjectInfo{}, ObjectInfo{}, kindError(ErrStaleUpload, err)
+		}
+		ac.logger.Error(errMsg, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+		return ObjectInfo{}, ObjectInfo{}, wrapStorageError(err, errMsg)
+	}
+
+	info, err := ac.blobProperties(ctx, dst.bucket, dstName)
+	if err != nil {
+		ac.logger.Error(errMsg, zap.Error(err), zap.String("dst", dstName))
+		return ObjectInfo{}, ObjectInfo{}, err
+	}
+	ac.logger.Debug("copied azure file", zap.String("src", srcName), zap.String("dst", dstName))
+	return info, srcInfo, nil
+}
+
+// waitForCopy polls destination blob until copy with given copy response header completes
+func (ac *azureStorageClient) waitForCopy(ctx context.Context, container, name string, header http.Header) error {
+	copyID := header.Get("X-Ms-Copy-Id")
+	status := header.Get("X-Ms-Copy-Status")
+	for status == "pending" {
+		select {
+		case <-ctx.Done():
+			return wrapStorageError(ctx.Err(), ERROR_STORAGE_CANCELED)
+		case <-time.After(azureCopyPollInterval):
+		}
+		resp, err := ac.do(ctx, http.MethodHead, container, name, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		// another copy or write replaced destination blob
+		if resp.Header.Get("X-Ms-Copy-Id") != copyID {
+			return kindError(ErrStaleUpload, ErrAzureCopyFailed)
+		}
+		status = resp.Header.Get("X-Ms-Copy-Status")
+	}
+	// failed or aborted copies may be retried
+	if status != "" && status != "success" {
+		return kindError(ErrTransient, ErrAzureCopyFailed)
+	}
+	return nil
+}
+
+// azureContentProperties maps blob content property response headers to set blob properties request headers
+var azureContentProperties = map[string]string{
+	"Content-Encoding":    "X-Ms-Blob-Content-Encoding",
+	"Content-Language":    "X-Ms-Blob-Content-Language",
+	"Content-Disposition": "X-Ms-Blob-Content-Disposition",
+	"Cache-Control":       "X-Ms-Blob-Cache-Control",
+	"Content-Md5":         "X-Ms-Blob-Content-Md5",
+}
+
+// setContentType sets blob content type, re-sending other content properties, which set blob properties clears
+func (ac *azureStorageClient) setContentType(ctx context.Context, container, name, contentType string) error {
+	resp, err := ac.do(ctx, http.MethodHead, container, name, nil, nil, nil)
+	if err != nil {
+		return wrapStorageError(err, "azure file inaccessible %s", name)
+	}
+	resp.Body.Close()
+
+	header := http.Header{}
+	header.Set("If-Match", resp.Header.Get("ETag"))
+	header.Set("X-Ms-Blob-Content-Type", contentType)
+	for prop, reqHeader := range azureContentProperties {
+		if value := resp.Header.Get(prop); value != "" {
+			header.Set(reqHeader, value)
+		}
+	}
+	resp, err = ac.do(ctx, http.MethodPut, container, name, url.Values{"comp": {"properties"}}, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (ac *azureStorageClient) DeleteObject(ctx context.Context, req CloudFileRequest) error {
+	if req.bucket == "" {
+		return ErrBucketNameMissing
+	}
+	if req.path == "" {
+		return ErrFilePathMissing
+	}
+	if req.file == "" {
+		return ErrFileNameMissing
+	}
+	name := req.objectName()
+
+	resp, err := ac.do(ctx, http.MethodDelete, req.bucket, name, nil, nil, nil)
+	if err != nil {
+		ac.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", name))
+		return wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteObjects deletes blobs under request prefix with a bounded worker pool,
+// continues past individual failures & returns incomplete delete error if any blob failed
+func (ac *azureStorageClient) DeleteObjects(ctx context.Context, req CloudFileRequest) (DeleteSummary, error) {
+	if err := req.validateList(); err != nil {
+		return DeleteSummary{}, err
+	}
+	// guard against wiping entire container
+	if req.path == "" && !req.deleteAll {
+		return DeleteSummary{}, ErrDeletePrefixMissing
+	}
+
+	list, err := ac.ListObjects(ctx, req)
+	if err != nil {
+		return DeleteSummary{}, err
+	}
+
+	summary, err := deleteObjectInfos(ctx, req, feedObjectInfos(list.Objects), ac.deleteListedObject)
+	if err != nil {
+		return summary, err
+	}
+	ac.logger.Info("deleted objects", zap.String("prefix", req.listPrefix()), zap.Bool("dryRun", req.dryRun), zap.Int("deleted", len(summary.Deleted)), zap.Int("failed", len(summary.Failed)))
+	if len(summary.Failed) > 0 {
+		return summary, ErrDeleteIncomplete
+	}
+	return summary, nil
+}
+
+// deleteListedObject deletes listed blob, if not replaced since listing, returns delete result
+func (ac *azureStorageClient) deleteListedObject(ctx context.Context, info ObjectInfo) DeleteResult {
+	result := DeleteResult{
+		Key: info.Name,
+	}
+	resp, err := ac.do(ctx, http.MethodDelete, info.Bucket, info.Name, nil, http.Header{"If-Match": {info.ETag}}, nil)
+	switch {
+	case err == nil:
+		resp.Body.Close()
+		ac.logger.Debug("deleted object", zap.String("name", info.Name))
+		result.Status = DeleteStatusDeleted
+	case hasStatus(err, http.StatusNotFound):
+		result.Status = DeleteStatusNotFound
+		result.Err = kindError(ErrObjectNotFound, err)
+	case isPreconditionFailed(err):
+		ac.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", info.Name))
+		result.Status = DeleteStatusPreconditionFailed
+		result.Err = kindError(ErrPreconditionFailed, err)
+	default:
+		ac.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", info.Name))
+		result.Status = DeleteStatusFailed
+		result.Err = wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	return result
+}
+
+func (ac *azureStorageClient) Close() error {
+	ac.client.CloseIdleConnections()
+	return nil
+}
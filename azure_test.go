@@ -0,0 +1,667 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// well known Azurite development account
+const (
+	testAzureAccount = "devstoreaccount1"
+	testAzureKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+func TestAzureFileStorage(t *testing.T) {
+	runStorageScenarios(t, func(t *testing.T, testCfg *testConfig) (CloudStorage, func()) {
+		return setupAzureTest(t, *testCfg, AzureClientConfig{AccountKey: testAzureKey})
+	})
+}
+
+func TestAzureBlockUpload(t *testing.T) {
+	testCfg := testConfig{
+		dir:    t.TempDir(),
+		bucket: "test-bucket",
+	}
+	client, teardown := setupAzureTest(t, testCfg, AzureClientConfig{
+		SASToken:  "?sv=2021-08-06&sp=racwdl&sig=test",
+		BlockSize: 1024,
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*3+8)
+	cfr, err := NewCloudFileRequest(testCfg.bucket, "large.bin", "blocks", 0, WithIfAbsent(), WithMetadata(map[string]string{"owner": "test"}))
+	require.NoError(t, err)
+
+	n, err := client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	info, err := client.StatObject(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+	require.Equal(t, "test", info.Metadata["owner"])
+
+	buf := bytes.Buffer{}
+	_, err = client.DownloadFile(ctx, &buf, cfr)
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+
+	p := make([]byte, 16)
+	_, err = client.ReadAt(ctx, cfr, p, 2048)
+	require.NoError(t, err)
+	require.Equal(t, data[2048:2064], p)
+
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+
+	missingCfr, err := NewCloudFileRequest(testCfg.bucket, "missing.bin", "blocks", 0)
+	require.NoError(t, err)
+	_, err = client.StatObject(ctx, missingCfr)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestAzureConcurrentBlockUploads(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+	fake := newFakeAzure()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.endpoint = srv.URL + "/" + testAzureAccount
+
+	client, err := NewAzureStorageClient(AzureClientConfig{
+		Endpoint:    fake.endpoint,
+		AccountName: testAzureAccount,
+		AccountKey:  testAzureKey,
+		BlockSize:   1024,
+	}, appLogger)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, client.Close())
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfr, err := NewCloudFileRequest("test-bucket", "shared.bin", "blocks", 0)
+	require.NoError(t, err)
+	payloads := [][]byte{
+		bytes.Repeat([]byte("a"), 3*1024+10),
+		bytes.Repeat([]byte("b"), 3*1024+10),
+	}
+
+	// second upload stages its blocks while first upload commit is held
+	fake.commits = make(chan chan struct{})
+	errs := make([]error, len(payloads))
+	done := make([]chan struct{}, len(payloads))
+	releases := make([]chan struct{}, len(payloads))
+	for i := range payloads {
+		done[i] = make(chan struct{})
+		go func(i int) {
+			defer close(done[i])
+			_, errs[i] = client.UploadFile(ctx, bytes.NewReader(payloads[i]), cfr)
+		}(i)
+		releases[i] = <-fake.commits
+	}
+	for i := range payloads {
+		close(releases[i])
+		<-done[i]
+	}
+
+	// first commit discards other upload's blocks, blob is never a mix of both uploads
+	succeeded := -1
+	for i, err := range errs {
+		if err == nil {
+			require.Equal(t, -1, succeeded)
+			succeeded = i
+		}
+	}
+	require.NotEqual(t, -1, succeeded)
+
+	buf := bytes.Buffer{}
+	_, err = client.DownloadFile(ctx, &buf, cfr)
+	require.NoError(t, err)
+	require.Equal(t, payloads[succeeded], buf.Bytes())
+}
+
+func TestAzureWaitForCopy(t *testing.T) {
+	testCfg := testConfig{
+		dir:    t.TempDir(),
+		bucket: "test-bucket",
+	}
+	client, teardown := setupAzureTest(t, testCfg, AzureClientConfig{})
+	defer teardown()
+	ac, ok := client.(*azureStorageClient)
+	require.Equal(t, true, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	header := http.Header{}
+	header.Set("X-Ms-Copy-Id", "1")
+	header.Set("X-Ms-Copy-Status", "success")
+	require.NoError(t, ac.waitForCopy(ctx, testCfg.bucket, "copy.json", header))
+
+	// failed copies are transient
+	header.Set("X-Ms-Copy-Status", "failed")
+	err := ac.waitForCopy(ctx, testCfg.bucket, "copy.json", header)
+	require.ErrorIs(t, err, ErrTransient)
+	require.ErrorIs(t, err, ErrAzureCopyFailed)
+
+	cCtx, cCancel := context.WithCancel(ctx)
+	cCancel()
+	header.Set("X-Ms-Copy-Status", "pending")
+	err = ac.waitForCopy(cCtx, testCfg.bucket, "copy.json", header)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, ErrCanceled)
+}
+
+func TestAzureMoveObjectSourceReplaced(t *testing.T) {
+	fake := newFakeAzure()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.endpoint = srv.URL + "/" + testAzureAccount
+
+	client, err := NewAzureStorageClient(AzureClientConfig{
+		Endpoint:    fake.endpoint,
+		AccountName: testAzureAccount,
+		AccountKey:  testAzureKey,
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, client.Close())
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := NewCloudFileRequest("test-bucket", "a.json", "staging", 0)
+	require.NoError(t, err)
+	dst, err := NewCloudFileRequest("test-bucket", "a.json", "published", 0)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader([]byte(`{"v":1}`)), src)
+	require.NoError(t, err)
+
+	// source replaced between copy & source delete
+	fake.afterCopy = func() {
+		fake.blobs["test-bucket/staging/a.json"].etag = `"replaced"`
+	}
+	_, err = client.MoveObject(ctx, src, dst)
+	require.ErrorIs(t, err, ErrStaleDownload)
+
+	// copied destination is deleted again, replaced source is kept
+	_, err = client.StatObject(ctx, dst)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = client.StatObject(ctx, src)
+	require.NoError(t, err)
+}
+
+func TestAzureCopyContentType(t *testing.T) {
+	fake := newFakeAzure()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.endpoint = srv.URL + "/" + testAzureAccount
+
+	client, err := NewAzureStorageClient(AzureClientConfig{
+		Endpoint:    fake.endpoint,
+		AccountName: testAzureAccount,
+		AccountKey:  testAzureKey,
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, client.Close())
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := NewCloudFileRequest("test-bucket", "a.json", "staging", 0)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader([]byte(`{"v":1}`)), src)
+	require.NoError(t, err)
+	srcHeader := fake.blobs["test-bucket/staging/a.json"].header
+	srcHeader.Set("Content-Language", "en")
+	srcHeader.Set("Cache-Control", "no-cache")
+	srcHeader.Set("Content-Disposition", "attachment")
+
+	// content type override keeps other content properties
+	dst, err := NewCloudFileRequest("test-bucket", "a.json", "published", 0, WithContentType("application/json"))
+	require.NoError(t, err)
+	info, err := client.CopyObject(ctx, src, dst)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", info.ContentType)
+
+	dstHeader := fake.blobs["test-bucket/published/a.json"].header
+	require.Equal(t, "en", dstHeader.Get("Content-Language"))
+	require.Equal(t, "no-cache", dstHeader.Get("Cache-Control"))
+	require.Equal(t, "attachment", dstHeader.Get("Content-Disposition"))
+	require.Equal(t, srcHeader.Get("Content-MD5"), dstHeader.Get("Content-MD5"))
+}
+
+func TestAzureListObjectsOffsets(t *testing.T) {
+	fake := newFakeAzure()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.endpoint = srv.URL + "/" + testAzureAccount
+
+	client, err := NewAzureStorageClient(AzureClientConfig{
+		Endpoint:    fake.endpoint,
+		AccountName: testAzureAccount,
+		AccountKey:  testAzureKey,
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, client.Close())
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, name := range []string{"a.json", "b.json", "c.json", "d.json", "e.json", "f.json", "g.json", "h.json"} {
+		cfr, err := NewCloudFileRequest("test-bucket", name, "offsets", 0)
+		require.NoError(t, err)
+		_, err = client.UploadFile(ctx, bytes.NewReader([]byte("{}")), cfr)
+		require.NoError(t, err)
+	}
+
+	// listing stops paging at end offset
+	cfr, err := NewCloudFileRequest("test-bucket", "", "offsets", 0, WithStartOffset("offsets/b.json"), WithEndOffset("offsets/d.json"))
+	require.NoError(t, err)
+	names := []string{}
+	pageToken := ""
+	for {
+		page, err := client.ListObjectsPage(ctx, cfr, 2, pageToken)
+		require.NoError(t, err)
+		for _, obj := range page.Objects {
+			names = append(names, obj.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	require.Equal(t, []string{"offsets/b.json", "offsets/c.json"}, names)
+	require.Equal(t, 2, len(fake.lists))
+}
+
+func TestNewAzureStorageBackend(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+	t.Setenv("AZURE_STORAGE_KEY", testAzureKey)
+
+	client, err := NewCloudStorage(CloudStorageClientConfig{StorageURL: "azblob://127.0.0.1:10000/devstoreaccount1?insecure=true"}, appLogger)
+	require.NoError(t, err)
+	ac, ok := client.(*azureStorageClient)
+	require.Equal(t, true, ok)
+	require.Equal(t, testAzureAccount, ac.config.AccountName)
+	require.Equal(t, "http://127.0.0.1:10000/devstoreaccount1/container/dir/a%20b.json", ac.blobURL("container", "dir/a b.json", nil).String())
+
+	client, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "azblob://myaccount"}, appLogger)
+	require.NoError(t, err)
+	ac = client.(*azureStorageClient)
+	require.Equal(t, "https://myaccount.blob.core.windows.net/container/dir/a.json", ac.blobURL("container", "dir/a.json", nil).String())
+
+	// GCS only settings aren't silently ignored
+	_, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "azblob://myaccount", Retry: &RetryPolicy{MaxAttempts: 1}}, appLogger)
+	require.ErrorIs(t, err, ErrUnsupportedConfig)
+
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "")
+	_, err = NewAzureStorageClient(AzureClientConfig{}, appLogger)
+	require.ErrorIs(t, err, ErrAzureAccountMissing)
+}
+
+func setupAzureTest(t *testing.T, testCfg testConfig, cfg AzureClientConfig) (
+	client CloudStorage,
+	teardown func(),
+) {
+	t.Helper()
+
+	fake := newFakeAzure()
+	srv := httptest.NewServer(fake)
+	fake.endpoint = srv.URL + "/" + testAzureAccount
+	cfg.Endpoint = fake.endpoint
+	cfg.AccountName = testAzureAccount
+	client, err := NewAzureStorageClient(cfg, logger.NewTestAppLogger(testCfg.dir))
+	require.NoError(t, err)
+
+	return client, func() {
+		err := client.Close()
+		require.NoError(t, err)
+		srv.Close()
+	}
+}
+
+type fakeAzureBlob struct {
+	data     []byte
+	etag     string
+	header   http.Header
+	created  time.Time
+	modified time.Time
+}
+
+// fakeAzure is an Azurite style blob service stand-in, keeping blobs in memory
+// & verifying shared key signatures, or presence of SAS signature
+type fakeAzure struct {
+	mu       sync.Mutex
+	seq      int
+	endpoint string
+	key      []byte
+	blobs    map[string]*fakeAzureBlob
+	blocks   map[string]map[string][]byte
+	// commits, when set, receives a release channel for each block list commit, held until released
+	commits chan chan struct{}
+	// afterCopy, when set, is called with fake locked once a copy succeeds
+	afterCopy func()
+	lists     []url.Values
+}
+
+func newFakeAzure() *fakeAzure {
+	key, _ := base64.StdEncoding.DecodeString(testAzureKey)
+	return &fakeAzure{
+		key:    key,
+		blobs:  map[string]*fakeAzureBlob{},
+		blocks: map[string]map[string][]byte{},
+	}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if auth != "SharedKey "+testAzureAccount+":"+azureSharedKeySignature(r, testAzureAccount, f.key) {
+			fakeAzureError(w, http.StatusForbidden, "AuthenticationFailed")
+			return
+		}
+	} else if query.Get("sig") == "" {
+		fakeAzureError(w, http.StatusForbidden, "NoAuthenticationInformation")
+		return
+	}
+
+	if f.commits != nil && r.Method == http.MethodPut && query.Get("comp") == "blocklist" {
+		release := make(chan struct{})
+		f.commits <- release
+		<-release
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resource := strings.TrimPrefix(r.URL.Path, "/"+testAzureAccount+"/")
+	container, name, _ := strings.Cut(resource, "/")
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case name == "" && r.Method == http.MethodGet && query.Get("comp") == "list":
+		f.list(w, container, query)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		f.get(w, r, resource)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if f.blocks[resource] == nil {
+			f.blocks[resource] = map[string][]byte{}
+		}
+		f.blocks[resource][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		blockList := azureBlockList{}
+		if err := xml.Unmarshal(body, &blockList); err != nil {
+			fakeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		data := []byte{}
+		for _, blockID := range blockList.Latest {
+			block, ok := f.blocks[resource][blockID]
+			if !ok {
+				fakeAzureError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		// uncommitted blocks are discarded on commit
+		if _, ok := f.put(w, r, resource, data, nil); ok {
+			delete(f.blocks, resource)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case r.Method == http.MethodPut && query.Get("comp") == "properties":
+		blob := f.blobs[resource]
+		if blob == nil {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != blob.etag {
+			fakeAzureError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+			return
+		}
+		f.seq++
+		blob.etag = fmt.Sprintf(`"0x%X"`, f.seq)
+		blob.modified = time.Now().UTC()
+		// content properties not sent are cleared
+		for prop, reqHeader := range azureContentProperties {
+			blob.header.Del(prop)
+			if value := r.Header.Get(reqHeader); value != "" {
+				blob.header.Set(prop, value)
+			}
+		}
+		blob.header.Set("Content-Type", r.Header.Get("X-Ms-Blob-Content-Type"))
+		w.Header().Set("ETag", blob.etag)
+	case r.Method == http.MethodPut && r.Header.Get("X-Ms-Copy-Source") != "":
+		srcURL, err := url.Parse(r.Header.Get("X-Ms-Copy-Source"))
+		if err != nil || !strings.HasPrefix(srcURL.String(), f.endpoint+"/") {
+			fakeAzureError(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		src := f.blobs[strings.TrimPrefix(srcURL.Path, "/"+testAzureAccount+"/")]
+		if src == nil {
+			fakeAzureError(w, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		if r.Header.Get("X-Ms-Source-If-Match") != src.etag {
+			fakeAzureError(w, http.StatusPreconditionFailed, "SourceConditionNotMet")
+			return
+		}
+		if _, ok := f.put(w, r, resource, src.data, src.header); ok {
+			if f.afterCopy != nil {
+				f.afterCopy()
+			}
+			w.Header().Set("X-Ms-Copy-Id", strconv.Itoa(f.seq))
+			w.Header().Set("X-Ms-Copy-Status", "success")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case r.Method == http.MethodPut && r.Header.Get("X-Ms-Blob-Type") == "BlockBlob":
+		if _, ok := f.put(w, r, resource, body, nil); ok {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case r.Method == http.MethodDelete:
+		blob := f.blobs[resource]
+		if blob == nil {
+			fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != blob.etag {
+			fakeAzureError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+			return
+		}
+		delete(f.blobs, resource)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		fakeAzureError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// put stores blob if write conditions hold, with properties from request, or from source when copying
+func (f *fakeAzure) put(w http.ResponseWriter, r *http.Request, resource string, data []byte, srcHeader http.Header) (*fakeAzureBlob, bool) {
+	current := f.blobs[resource]
+	if r.Header.Get("If-None-Match") == "*" && current != nil {
+		fakeAzureError(w, http.StatusConflict, "BlobAlreadyExists")
+		return nil, false
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (current == nil || current.etag != ifMatch) {
+		fakeAzureError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+		return nil, false
+	}
+
+	f.seq++
+	now := time.Now().UTC()
+	blob := &fakeAzureBlob{
+		data:     data,
+		etag:     fmt.Sprintf(`"0x%X"`, f.seq),
+		header:   http.Header{},
+		created:  now,
+		modified: now,
+	}
+	if current != nil {
+		blob.created = current.created
+	}
+	sum := md5.Sum(data)
+	blob.header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	hasMeta := false
+	for name, values := range r.Header {
+		switch {
+		case name == "X-Ms-Blob-Content-Type":
+			blob.header["Content-Type"] = values
+		case name == "X-Ms-Blob-Content-Encoding":
+			blob.header["Content-Encoding"] = values
+		case name == "X-Ms-Access-Tier":
+			blob.header[name] = values
+		case strings.HasPrefix(name, azureMetaHeaderPrefix):
+			blob.header[name] = values
+			hasMeta = true
+		}
+	}
+	// copies keep source properties, metadata is replaced if set on request
+	for name, values := range srcHeader {
+		if _, ok := blob.header[name]; ok || (hasMeta && strings.HasPrefix(name, azureMetaHeaderPrefix)) {
+			continue
+		}
+		blob.header[name] = values
+	}
+	f.blobs[resource] = blob
+	w.Header().Set("ETag", blob.etag)
+	return blob, true
+}
+
+func (f *fakeAzure) get(w http.ResponseWriter, r *http.Request, resource string) {
+	blob := f.blobs[resource]
+	if blob == nil {
+		fakeAzureError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != blob.etag {
+		fakeAzureError(w, http.StatusPreconditionFailed, "ConditionNotMet")
+		return
+	}
+
+	for name, values := range blob.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("ETag", blob.etag)
+	w.Header().Set("Last-Modified", blob.modified.Format(http.TimeFormat))
+	w.Header().Set("X-Ms-Creation-Time", blob.created.Format(http.TimeFormat))
+	w.Header().Set("X-Ms-Blob-Type", "BlockBlob")
+
+	data, status := blob.data, http.StatusOK
+	if rng := r.Header.Get("X-Ms-Range"); rng != "" {
+		start, end, _ := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+		off, _ := strconv.Atoi(start)
+		if off >= len(data) {
+			fakeAzureError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		last := len(data) - 1
+		if end != "" {
+			if l, _ := strconv.Atoi(end); l < last {
+				last = l
+			}
+		}
+		data, status = data[off:last+1], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, container string, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxResults := 5000
+	if mr := query.Get("maxresults"); mr != "" {
+		maxResults, _ = strconv.Atoi(mr)
+	}
+	f.lists = append(f.lists, query)
+	after := query.Get("marker")
+
+	names := []string{}
+	for resource := range f.blobs {
+		if name := strings.TrimPrefix(resource, container+"/"); name != resource && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := bytes.Buffer{}
+	seen := map[string]bool{}
+	cnt, last, truncated := 0, "", false
+	for _, name := range names {
+		entry := name
+		if delimiter != "" {
+			if idx := strings.Index(name[len(prefix):], delimiter); idx >= 0 {
+				entry = name[:len(prefix)+idx+len(delimiter)]
+			}
+		}
+		if entry <= after || seen[entry] {
+			continue
+		}
+		if cnt == maxResults {
+			truncated = true
+			break
+		}
+		seen[entry], cnt, last = true, cnt+1, entry
+
+		if entry != name {
+			fmt.Fprintf(&result, "<BlobPrefix><Name>%s</Name></BlobPrefix>", html.EscapeString(entry))
+			continue
+		}
+		blob := f.blobs[container+"/"+name]
+		fmt.Fprintf(&result, "<Blob><Name>%s</Name><Properties><Creation-Time>%s</Creation-Time><Last-Modified>%s</Last-Modified><Etag>%s</Etag><Content-Length>%d</Content-Length><Content-Type>%s</Content-Type><Content-MD5>%s</Content-MD5><AccessTier>Hot</AccessTier></Properties><Metadata>",
+			html.EscapeString(name), blob.created.Format(http.TimeFormat), blob.modified.Format(http.TimeFormat), blob.etag, len(blob.data), html.EscapeString(blob.header.Get("Content-Type")), blob.header.Get("Content-MD5"))
+		for hName, values := range blob.header {
+			if strings.HasPrefix(hName, azureMetaHeaderPrefix) {
+				fmt.Fprintf(&result, "<%s>%s</%s>", strings.ToLower(hName[len(azureMetaHeaderPrefix):]), html.EscapeString(values[0]), strings.ToLower(hName[len(azureMetaHeaderPrefix):]))
+			}
+		}
+		result.WriteString("</Metadata></Blob>")
+	}
+	fmt.Fprint(w, "<EnumerationResults><Blobs>")
+	w.Write(result.Bytes())
+	fmt.Fprint(w, "</Blobs>")
+	if truncated {
+		fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", html.EscapeString(last))
+	} else {
+		fmt.Fprint(w, "<NextMarker />")
+	}
+	fmt.Fprint(w, "</EnumerationResults>")
+}
+
+func fakeAzureError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
@@ -0,0 +1,135 @@
+package cloudstorage
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/comfforts/errors"
+	"github.com/comfforts/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	GCS_SCHEME     = "gs"
+	DEFAULT_SCHEME = GCS_SCHEME
+)
+
+// BackendFactory takes client config, parsed storage URL & logger, returns cloud storage backend
+type BackendFactory func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+func init() {
+	// gs:// for GCS, gs://host:port or gs://host?emulator=true for emulator or custom endpoint,
+	// unauthenticated only with anonymous query param. Other hosts are rejected, buckets are set on requests
+	RegisterBackend(GCS_SCHEME, func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		if storageURL.Host != "" {
+			query := storageURL.Query()
+			emulator := storageURL.Port() != ""
+			if value := query.Get("emulator"); value != "" {
+				var err error
+				if emulator, err = strconv.ParseBool(value); err != nil {
+					logger.Error(ERROR_INVALID_STORAGE_URL, zap.String("storageURL", storageURL.String()))
+					return nil, ErrInvalidStorageURL
+				}
+			}
+			if !emulator {
+				logger.Error(ERROR_INVALID_STORAGE_URL, zap.String("storageURL", storageURL.String()), zap.String("host", storageURL.Host))
+				return nil, ErrInvalidStorageURL
+			}
+			cfg.Endpoint = storageURL.Host + storageURL.Path
+		}
+		if anonymous := storageURL.Query().Get("anonymous"); anonymous != "" {
+			var err error
+			if cfg.Anonymous, err = strconv.ParseBool(anonymous); err != nil {
+				logger.Error(ERROR_INVALID_STORAGE_URL, zap.String("storageURL", storageURL.String()))
+				return nil, ErrInvalidStorageURL
+			}
+		}
+		return NewCloudStorageClient(cfg, logger)
+	})
+}
+
+// gcsOnlyConfig returns names of set client config fields only GCS clients use, for backends configured by URL
+func gcsOnlyConfig(cfg CloudStorageClientConfig) []string {
+	fields := []string{}
+	if cfg.CredsPath != "" || len(cfg.CredsJSON) > 0 || cfg.TokenSource != nil {
+		fields = append(fields, "credentials")
+	}
+	if cfg.ImpersonateServiceAccount != "" || len(cfg.ImpersonateDelegates) > 0 {
+		fields = append(fields, "impersonation")
+	}
+	if cfg.Endpoint != "" || cfg.Anonymous {
+		fields = append(fields, "endpoint")
+	}
+	if cfg.TransferTimeout != 0 || cfg.MetadataTimeout != 0 {
+		fields = append(fields, "timeouts")
+	}
+	if cfg.Retry != nil {
+		fields = append(fields, "retry")
+	}
+	if cfg.ChunkSize != 0 || cfg.BufferSize != 0 {
+		fields = append(fields, "buffer sizes")
+	}
+	return fields
+}
+
+// rejectGCSOnlyConfig returns unsupported config error if client config sets fields only GCS clients use,
+// so settings aren't silently ignored
+func rejectGCSOnlyConfig(cfg CloudStorageClientConfig, logger logger.AppLogger) error {
+	if fields := gcsOnlyConfig(cfg); len(fields) > 0 {
+		logger.Error(ERROR_UNSUPPORTED_CONFIG, zap.String("storageURL", cfg.StorageURL), zap.Strings("fields", fields))
+		return ErrUnsupportedConfig
+	}
+	return nil
+}
+
+// RegisterBackend registers backend factory for given storage URL scheme, replaces existing registration
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[strings.ToLower(scheme)] = factory
+}
+
+// Backends returns registered storage URL schemes
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	return schemes
+}
+
+// NewCloudStorage takes client config & logger, returns cloud storage backend
+// selected by config storage URL scheme, GCS when storage URL is empty
+func NewCloudStorage(cfg CloudStorageClientConfig, logger logger.AppLogger) (CloudStorage, error) {
+	if logger == nil {
+		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+
+	rawURL := cfg.StorageURL
+	if rawURL == "" {
+		rawURL = DEFAULT_SCHEME + "://"
+	}
+	storageURL, err := url.Parse(rawURL)
+	if err != nil || storageURL.Scheme == "" {
+		logger.Error(ERROR_INVALID_STORAGE_URL, zap.String("storageURL", rawURL))
+		return nil, ErrInvalidStorageURL
+	}
+
+	backendsMu.RLock()
+	factory, ok := backends[strings.ToLower(storageURL.Scheme)]
+	backendsMu.RUnlock()
+	if !ok {
+		logger.Error(ERROR_UNSUPPORTED_SCHEME, zap.String("scheme", storageURL.Scheme))
+		return nil, ErrUnsupportedScheme
+	}
+	return factory(cfg, storageURL, logger)
+}
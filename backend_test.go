@@ -0,0 +1,75 @@
+package cloudstorage
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCloudStorageBackends(t *testing.T) {
+	testCfg := getTestConfig()
+	appLogger := logger.NewTestAppLogger(testCfg.dir)
+
+	_, err := NewCloudStorage(CloudStorageClientConfig{StorageURL: "unknown://bucket"}, appLogger)
+	require.ErrorIs(t, err, ErrUnsupportedScheme)
+
+	_, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "no-scheme"}, appLogger)
+	require.ErrorIs(t, err, ErrInvalidStorageURL)
+
+	var gotURL *url.URL
+	RegisterBackend("test", func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		gotURL = storageURL
+		return nil, nil
+	})
+	_, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "TEST://host/root"}, appLogger)
+	require.NoError(t, err)
+	require.Equal(t, "host", gotURL.Host)
+	require.Equal(t, "/root", gotURL.Path)
+	require.Contains(t, Backends(), GCS_SCHEME)
+}
+
+func TestNewGCSEmulatorBackend(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+
+	client, err := NewCloudStorage(CloudStorageClientConfig{StorageURL: "gs://localhost:4443?anonymous=true"}, appLogger)
+	require.NoError(t, err)
+	csc, ok := client.(*cloudStorageClient)
+	require.Equal(t, true, ok)
+	require.Equal(t, "localhost:4443", csc.config.Endpoint)
+	require.Equal(t, true, csc.config.Anonymous)
+	require.NoError(t, client.Close())
+
+	// hosts without port are emulators only when explicit
+	client, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "gs://gcs-emulator?emulator=true&anonymous=true"}, appLogger)
+	require.NoError(t, err)
+	csc, ok = client.(*cloudStorageClient)
+	require.Equal(t, true, ok)
+	require.Equal(t, "gcs-emulator", csc.config.Endpoint)
+	require.Equal(t, true, csc.config.Anonymous)
+	require.NoError(t, client.Close())
+
+	// bucket names are not endpoints
+	for _, storageURL := range []string{
+		"gs://my-bucket",
+		"gs://my-bucket?emulator=false",
+		"gs://localhost:4443?emulator=maybe",
+		"gs://localhost:4443?anonymous=maybe",
+	} {
+		_, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: storageURL}, appLogger)
+		require.ErrorIs(t, err, ErrInvalidStorageURL, storageURL)
+	}
+
+	for endpoint, expected := range map[string]string{
+		"localhost:4443":                         "http://localhost:4443/storage/v1/",
+		"http://127.0.0.1:8081/":                 "http://127.0.0.1:8081/storage/v1/",
+		"https://storage.example.com/storage/v1": "https://storage.example.com/storage/v1/",
+	} {
+		got, err := gcsEndpoint(endpoint)
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	}
+	_, err = gcsEndpoint("http://")
+	require.ErrorIs(t, err, ErrInvalidStorageURL)
+}
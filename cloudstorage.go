@@ -2,32 +2,56 @@ package cloudstorage
 
 import (
 	"context"
-	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/comfforts/errors"
 	"github.com/comfforts/logger"
 	"go.uber.org/zap"
-	"google.golang.org/api/iterator"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
 type CloudStorage interface {
-	// UploadFile uploads file to given cloud bucket & filepath, creates a new one or replaces existing
+	// UploadFile uploads file to given cloud bucket & filepath, creates a new one or replaces existing,
+	// returns stale upload error if request preconditions or modification time don't hold
 	UploadFile(context.Context, io.Reader, CloudFileRequest) (int64, error)
 	// DownloadFile copies content of file at given cloud bucket & filepath to given file
 	DownloadFile(context.Context, io.Writer, CloudFileRequest) (int64, error)
-	// Reads file data of givine length at given offset
+	// ReadAt reads len(p) bytes of file data at given offset, fetching only the requested range.
+	// First read of a request pins object generation current at that time, unless request sets WithGeneration,
+	// later reads with the request or its copies fail with stale download error once object is replaced.
+	// Gzip encoded GCS objects are read as stored, compressed, unlike DownloadFile which decompresses them
 	ReadAt(ctx context.Context, cfr CloudFileRequest, p []byte, off int64) (int, error)
-	// ListObjects lists objects at given cloud bucket
-	ListObjects(context.Context, CloudFileRequest) ([]string, error)
+	// StatObject returns attributes of file at given cloud bucket & filepath, object not found error if it doesn't exist
+	StatObject(context.Context, CloudFileRequest) (ObjectInfo, error)
+	// OpenObject opens a read handle for file at given cloud bucket & filepath
+	OpenObject(context.Context, CloudFileRequest) (CloudObject, error)
+	// ListObjects lists objects under given cloud bucket & filepath,
+	// with delimiter set, lists directory prefixes separately
+	ListObjects(context.Context, CloudFileRequest) (ObjectList, error)
+	// ListObjectsPage lists one page of objects of given size, starting at given page token
+	ListObjectsPage(ctx context.Context, cfr CloudFileRequest, pageSize int, pageToken string) (ObjectList, error)
+	// StreamObjects streams objects under given cloud bucket & filepath until done or context is cancelled
+	StreamObjects(context.Context, CloudFileRequest) <-chan ListEntry
+	// CopyObject copies source file to destination bucket & filepath server side,
+	// destination request sets content type, storage class & metadata overrides
+	CopyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error)
+	// MoveObject copies source file to destination & deletes copied source generation. Source replaced
+	// during move fails with stale download error & copied destination generation is deleted again
+	MoveObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error)
 	// DeleteObject delete file at given cloud bucket & filepath
 	DeleteObject(context.Context, CloudFileRequest) error
-	// DeleteObjects delete files at given cloud bucket
-	DeleteObjects(context.Context, CloudFileRequest) error
+	// DeleteObjects delete files under given cloud bucket & filepath concurrently, returns per key delete summary
+	DeleteObjects(context.Context, CloudFileRequest) (DeleteSummary, error)
 	// Close closes storage client connections
 	Close() error
 }
@@ -42,45 +66,146 @@ const (
 	ERROR_MISSING_FILE_NAME       string = "file name missing"
 	ERROR_STALE_UPLOAD            string = "storage bucket object has updates"
 	ERROR_STALE_DOWNLOAD          string = "file object has updates"
+	ERROR_INVALID_OFFSET          string = "invalid read offset"
+	ERROR_INVALID_SEEK            string = "invalid seek"
+	ERROR_OBJECT_CLOSED           string = "cloud object handle closed"
+	ERROR_INVALID_GLOB            string = "invalid glob pattern"
+	ERROR_INVALID_PAGE_SIZE       string = "invalid page size"
+	ERROR_MISSING_DELETE_PREFIX   string = "delete prefix missing, bucket wide delete not enabled"
+	ERROR_DELETE_INCOMPLETE       string = "some storage bucket objects failed to delete"
+	ERROR_COPYING_OBJECT          string = "error copying storage bucket object"
+	ERROR_MOVING_OBJECT           string = "error moving storage bucket object"
+	ERROR_OBJECT_NOT_FOUND        string = "storage bucket object not found"
+	ERROR_BUCKET_NOT_FOUND        string = "storage bucket not found"
+	ERROR_PERMISSION_DENIED       string = "storage permission denied"
+	ERROR_PRECONDITION_FAILED     string = "storage precondition failed"
+	ERROR_STALE                   string = "storage object has updates"
+	ERROR_RATE_LIMITED            string = "storage rate limited"
+	ERROR_TRANSIENT               string = "transient storage failure"
+	ERROR_INVALID_STORAGE_URL     string = "invalid storage URL"
+	ERROR_UNSUPPORTED_SCHEME      string = "unsupported storage URL scheme"
+	ERROR_INVALID_PAGE_TOKEN      string = "invalid page token"
+	ERROR_STORAGE_CANCELED        string = "storage request canceled"
+	ERROR_INVALID_BUCKET_NAME     string = "invalid bucket name"
+	ERROR_INVALID_OBJECT_NAME     string = "invalid object name"
+	ERROR_DECODING_RESPONSE       string = "error decoding storage response"
+	ERROR_CONFLICTING_CREDENTIALS string = "conflicting storage credentials"
+	ERROR_INVALID_ACCOUNT         string = "invalid storage account"
+	ERROR_NO_ACCOUNT              string = "no storage account for bucket"
+	ERROR_POOL_CLOSED             string = "storage client pool closed"
+	ERROR_UPLOAD_SESSION          string = "error starting resumable upload session"
+	ERROR_UPLOAD_SESSION_EXPIRED  string = "resumable upload session expired"
+	ERROR_LOADING_CHECKPOINT      string = "error loading upload checkpoint"
+	ERROR_SAVING_CHECKPOINT       string = "error saving upload checkpoint"
+	ERROR_INVALID_SIZE            string = "invalid file size"
+	ERROR_COMPOSING_OBJECT        string = "error composing storage bucket object"
+	ERROR_CHECKSUM_MISMATCH       string = "downloaded file checksum mismatch"
+	ERROR_MISSING_AZURE_ACCOUNT   string = "azure storage account name missing"
+	ERROR_AZURE_COPY_FAILED       string = "azure blob copy failed"
+	ERROR_UNSUPPORTED_CONFIG      string = "client config not supported by storage backend"
 )
 
 var (
-	ErrBucketNameMissing = errors.NewAppError(ERROR_MISSING_BUCKET_NAME)
-	ErrFilePathMissing   = errors.NewAppError(ERROR_MISSING_FILE_PATH)
-	ErrFileNameMissing   = errors.NewAppError(ERROR_MISSING_FILE_NAME)
+	ErrBucketNameMissing      = errors.NewAppError(ERROR_MISSING_BUCKET_NAME)
+	ErrFilePathMissing        = errors.NewAppError(ERROR_MISSING_FILE_PATH)
+	ErrFileNameMissing        = errors.NewAppError(ERROR_MISSING_FILE_NAME)
+	ErrInvalidOffset          = errors.NewAppError(ERROR_INVALID_OFFSET)
+	ErrInvalidSeek            = errors.NewAppError(ERROR_INVALID_SEEK)
+	ErrObjectClosed           = errors.NewAppError(ERROR_OBJECT_CLOSED)
+	ErrStaleDownload          = errors.NewAppError(ERROR_STALE_DOWNLOAD)
+	ErrStaleUpload            = errors.NewAppError(ERROR_STALE_UPLOAD)
+	ErrInvalidGlob            = errors.NewAppError(ERROR_INVALID_GLOB)
+	ErrInvalidPageSize        = errors.NewAppError(ERROR_INVALID_PAGE_SIZE)
+	ErrDeletePrefixMissing    = errors.NewAppError(ERROR_MISSING_DELETE_PREFIX)
+	ErrDeleteIncomplete       = errors.NewAppError(ERROR_DELETE_INCOMPLETE)
+	ErrObjectNotFound         = errors.NewAppError(ERROR_OBJECT_NOT_FOUND)
+	ErrBucketNotFound         = errors.NewAppError(ERROR_BUCKET_NOT_FOUND)
+	ErrPermissionDenied       = errors.NewAppError(ERROR_PERMISSION_DENIED)
+	ErrPreconditionFailed     = errors.NewAppError(ERROR_PRECONDITION_FAILED)
+	ErrStale                  = errors.NewAppError(ERROR_STALE)
+	ErrRateLimited            = errors.NewAppError(ERROR_RATE_LIMITED)
+	ErrTransient              = errors.NewAppError(ERROR_TRANSIENT)
+	ErrInvalidStorageURL      = errors.NewAppError(ERROR_INVALID_STORAGE_URL)
+	ErrUnsupportedScheme      = errors.NewAppError(ERROR_UNSUPPORTED_SCHEME)
+	ErrInvalidPageToken       = errors.NewAppError(ERROR_INVALID_PAGE_TOKEN)
+	ErrCanceled               = errors.NewAppError(ERROR_STORAGE_CANCELED)
+	ErrInvalidBucketName      = errors.NewAppError(ERROR_INVALID_BUCKET_NAME)
+	ErrInvalidObjectName      = errors.NewAppError(ERROR_INVALID_OBJECT_NAME)
+	ErrConflictingCredentials = errors.NewAppError(ERROR_CONFLICTING_CREDENTIALS)
+	ErrInvalidAccount         = errors.NewAppError(ERROR_INVALID_ACCOUNT)
+	ErrNoAccount              = errors.NewAppError(ERROR_NO_ACCOUNT)
+	ErrPoolClosed             = errors.NewAppError(ERROR_POOL_CLOSED)
+	ErrUploadSessionExpired   = errors.NewAppError(ERROR_UPLOAD_SESSION_EXPIRED)
+	ErrInvalidSize            = errors.NewAppError(ERROR_INVALID_SIZE)
+	ErrChecksumMismatch       = errors.NewAppError(ERROR_CHECKSUM_MISMATCH)
+	ErrAzureAccountMissing    = errors.NewAppError(ERROR_MISSING_AZURE_ACCOUNT)
+	ErrAzureCopyFailed        = errors.NewAppError(ERROR_AZURE_COPY_FAILED)
+	ErrUnsupportedConfig      = errors.NewAppError(ERROR_UNSUPPORTED_CONFIG)
 )
 
+// BufferSize is size of upload chunks & copy buffers
 type BufferSize int64
 
 const (
-	OneKB               BufferSize = 1024      // 1KB
-	ThirtyTwoKB         BufferSize = 32 * 1024 // 32KB
-	DEFAULT_BUFFER_SIZE            = OneKB
+	OneKB         BufferSize = 1024             // 1KB
+	ThirtyTwoKB   BufferSize = 32 * 1024        // 32KB
+	TwoFiftySixKB BufferSize = 256 * 1024       // 256KB
+	EightMB       BufferSize = 8 * 1024 * 1024  // 8MB
+	SixteenMB     BufferSize = 16 * 1024 * 1024 // 16MB
+	// SingleShot uploads object in a single request, without a resumable session or chunk buffer, for small files
+	SingleShot BufferSize = -1
+	// DEFAULT_BUFFER_SIZE is copy buffer size, same as io.Copy
+	DEFAULT_BUFFER_SIZE = ThirtyTwoKB
+)
+
+const (
+	DEFAULT_TRANSFER_TIMEOUT = 50 * time.Second
+	DEFAULT_METADATA_TIMEOUT = 30 * time.Second
+	// NoTimeout bounds calls by caller context only
+	NoTimeout time.Duration = -1
 )
 
 type CloudStorageClientConfig struct {
-	CredsPath string `json:"creds_path"`
+	// StorageURL selects storage backend by scheme, e.g. gs://, file:///data, mem://
+	StorageURL string `json:"storage_url"`
+	// CredsPath, CredsJSON & TokenSource are alternative client credentials,
+	// application default credentials are used when none is set
+	CredsPath   string             `json:"creds_path"`
+	CredsJSON   []byte             `json:"-"`
+	TokenSource oauth2.TokenSource `json:"-"`
+	// ImpersonateServiceAccount is target service account email, impersonated with client credentials
+	ImpersonateServiceAccount string   `json:"impersonate_service_account"`
+	ImpersonateDelegates      []string `json:"impersonate_delegates"`
+	// Endpoint overrides GCS JSON API endpoint, e.g. http://localhost:4443 for fake-gcs-server,
+	// STORAGE_EMULATOR_HOST is honoured when empty
+	Endpoint string `json:"endpoint"`
+	// Anonymous sends unauthenticated requests, for emulators & public buckets
+	Anonymous bool `json:"anonymous"`
+	// TransferTimeout bounds upload, download, read & copy calls, DEFAULT_TRANSFER_TIMEOUT when zero, NoTimeout for none
+	TransferTimeout time.Duration `json:"transfer_timeout"`
+	// MetadataTimeout bounds stat, page listing & delete calls, DEFAULT_METADATA_TIMEOUT when zero, NoTimeout for none.
+	// Full listings & prefix deletes are bounded by caller context only
+	MetadataTimeout time.Duration `json:"metadata_timeout"`
+	// Retry is retry policy of failed calls, DefaultRetryPolicy when nil. Timeouts bound calls including retries
+	Retry *RetryPolicy `json:"retry"`
+	// ChunkSize is upload chunk size, buffered in memory per upload, rounded up to a multiple of 256KB.
+	// Storage library default, 16MB, when zero, SingleShot uploads without chunking
+	ChunkSize BufferSize `json:"chunk_size"`
+	// BufferSize is upload & download copy buffer size, DEFAULT_BUFFER_SIZE when zero.
+	// Unused when readers or writers copy directly, e.g. files & in-memory readers
+	BufferSize BufferSize `json:"buffer_size"`
 }
 
 type cloudStorageClient struct {
-	client *storage.Client
-	config CloudStorageClientConfig
-	logger logger.AppLogger
-}
-
-type GCPStorageReadAtAdaptor struct {
-	Reader *storage.Reader
-}
-
-func (ra *GCPStorageReadAtAdaptor) ReadAt(p []byte, off int64) (n int, err error) {
-	// Seek to the desired offset
-	_, err = io.CopyN(io.Discard, ra.Reader, off)
-	if err != nil {
-		return 0, err
-	}
-
-	// Read the requested data
-	return ra.Reader.Read(p)
+	client    *storage.Client
+	config    CloudStorageClientConfig
+	retry     RetryPolicy
+	opts      []option.ClientOption
+	uploadURL string
+	hcOnce    sync.Once
+	hc        *http.Client
+	hcErr     error
+	logger    logger.AppLogger
 }
 
 // NewCloudStorageClient takes client config & logger, returns cloud storage client
@@ -88,40 +213,331 @@ func NewCloudStorageClient(cfg CloudStorageClientConfig, logger logger.AppLogger
 	if logger == nil {
 		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
 	}
-	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", cfg.CredsPath)
-	client, err := storage.NewClient(context.Background())
+	ctx := context.Background()
+	opts, err := gcsClientOptions(ctx, cfg)
+	if err != nil {
+		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err), zap.String("endpoint", cfg.Endpoint))
+		return nil, err
+	}
+	uploadURL, err := gcsUploadURL(cfg)
+	if err != nil {
+		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err), zap.String("endpoint", cfg.Endpoint))
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err))
-		return nil, errors.WrapError(err, ERROR_CREATING_STORAGE_CLIENT)
+		return nil, wrapStorageError(err, ERROR_CREATING_STORAGE_CLIENT)
+	}
+	if cfg.TransferTimeout == 0 {
+		cfg.TransferTimeout = DEFAULT_TRANSFER_TIMEOUT
+	}
+	if cfg.MetadataTimeout == 0 {
+		cfg.MetadataTimeout = DEFAULT_METADATA_TIMEOUT
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DEFAULT_BUFFER_SIZE
+	}
+	retry := DefaultRetryPolicy()
+	if cfg.Retry != nil {
+		retry = cfg.Retry.withDefaults()
 	}
+	client.SetRetry(retry.gcsRetryOptions()...)
 
 	loaderClient := &cloudStorageClient{
-		client: client,
-		config: cfg,
-		logger: logger,
+		client:    client,
+		config:    cfg,
+		retry:     retry,
+		opts:      opts,
+		uploadURL: uploadURL,
+		logger:    logger,
 	}
 
 	return loaderClient, nil
 }
 
+// gcsClientOptions returns storage client options for config endpoint override & credentials,
+// scoped to the client. Emulator endpoint set with STORAGE_EMULATOR_HOST is unauthenticated
+func gcsClientOptions(ctx context.Context, cfg CloudStorageClientConfig) ([]option.ClientOption, error) {
+	opts := []option.ClientOption{}
+	if cfg.Endpoint != "" {
+		endpoint, err := gcsEndpoint(cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	if cfg.Anonymous || (cfg.Endpoint == "" && os.Getenv("STORAGE_EMULATOR_HOST") != "") {
+		return append(opts, option.WithoutAuthentication()), nil
+	}
+
+	credOpts := []option.ClientOption{}
+	if cfg.CredsPath != "" {
+		credOpts = append(credOpts, option.WithCredentialsFile(cfg.CredsPath))
+	}
+	if len(cfg.CredsJSON) > 0 {
+		credOpts = append(credOpts, option.WithCredentialsJSON(cfg.CredsJSON))
+	}
+	if cfg.TokenSource != nil {
+		credOpts = append(credOpts, option.WithTokenSource(cfg.TokenSource))
+	}
+	if len(credOpts) > 1 {
+		return nil, ErrConflictingCredentials
+	}
+
+	// impersonated service account tokens are minted with client credentials, or application default credentials
+	if cfg.ImpersonateServiceAccount != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: cfg.ImpersonateServiceAccount,
+			Delegates:       cfg.ImpersonateDelegates,
+			Scopes:          []string{storage.ScopeFullControl},
+		}, credOpts...)
+		if err != nil {
+			return nil, wrapStorageError(err, ERROR_CREATING_STORAGE_CLIENT)
+		}
+		credOpts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+	return append(opts, credOpts...), nil
+}
+
+// gcsEndpoint takes endpoint host or URL, returns JSON API endpoint URL,
+// http is assumed when scheme is missing, like for STORAGE_EMULATOR_HOST
+func gcsEndpoint(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", ErrInvalidStorageURL
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/storage/v1/"
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
 type CloudFileRequest struct {
-	bucket  string
-	file    string
-	path    string
-	modTime int64
+	bucket         string
+	file           string
+	path           string
+	modTime        int64
+	generation     int64
+	metageneration int64
+	ifAbsent       bool
+	delimiter      string
+	glob           string
+	startOffset    string
+	endOffset      string
+	dryRun         bool
+	deleteAll      bool
+	concurrency    int
+	contentType    string
+	storageClass   string
+	metadata       map[string]string
+	timeout        time.Duration
+	chunkSize      BufferSize
+	bufferSize     BufferSize
+	partSize       BufferSize
+	tempPrefix     string
+	pin            *readPin
+}
+
+// readPin holds object generation & etag pinned by first read of a request, shared by request copies
+type readPin struct {
+	mu         sync.Mutex
+	generation int64
+	etag       string
+}
+
+// CloudFileRequestOption sets optional cloud file request attributes
+type CloudFileRequestOption func(*CloudFileRequest)
+
+// WithGeneration pins reads to given object generation,
+// reads fail with stale download error once object is replaced,
+// uploads replace object only if its generation matches
+func WithGeneration(gen int64) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.generation = gen
+	}
+}
+
+// WithMetageneration uploads replace object only if its metageneration matches
+func WithMetageneration(metagen int64) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.metageneration = metagen
+	}
 }
 
-// NewCloudFileRequest takes bucket name, file name & filepath, return cloud storage request
-func NewCloudFileRequest(bucketName, fileName, path string, modTime int64) (CloudFileRequest, error) {
+// WithIfAbsent uploads create object only if it doesn't exist
+func WithIfAbsent() CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.ifAbsent = true
+	}
+}
+
+// WithContentType sets content type of uploaded or copied object
+func WithContentType(contentType string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.contentType = contentType
+	}
+}
+
+// WithStorageClass sets storage class of uploaded or copied object
+func WithStorageClass(storageClass string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.storageClass = storageClass
+	}
+}
+
+// WithMetadata sets custom metadata of uploaded or copied object
+func WithMetadata(metadata map[string]string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.metadata = metadata
+	}
+}
+
+// WithTimeout overrides client default timeout of request calls, NoTimeout bounds calls by caller context only,
+// copies & moves use destination request timeout. GCS only, S3 & Azure calls are bounded by caller context
+func WithTimeout(timeout time.Duration) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.timeout = timeout
+	}
+}
+
+// WithChunkSize overrides client upload chunk size, SingleShot uploads without chunking
+func WithChunkSize(size BufferSize) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.chunkSize = size
+	}
+}
+
+// WithBufferSize overrides client copy buffer size of uploads & downloads
+func WithBufferSize(size BufferSize) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.bufferSize = size
+	}
+}
+
+// NewCloudFileRequest takes bucket name, file name, filepath & options, return cloud storage request
+func NewCloudFileRequest(bucketName, fileName, path string, modTime int64, opts ...CloudFileRequestOption) (CloudFileRequest, error) {
 	if bucketName == "" {
 		return CloudFileRequest{}, ErrBucketNameMissing
 	}
-	return CloudFileRequest{
+	cfr := CloudFileRequest{
 		bucket:  bucketName,
 		file:    fileName,
 		path:    path,
 		modTime: modTime,
-	}, nil
+		pin:     &readPin{},
+	}
+	for _, opt := range opts {
+		opt(&cfr)
+	}
+	return cfr, nil
+}
+
+// Generation returns object generation request reads are pinned to, 0 if not pinned
+func (cfr CloudFileRequest) Generation() int64 {
+	if cfr.generation > 0 || cfr.pin == nil {
+		return cfr.generation
+	}
+	cfr.pin.mu.Lock()
+	defer cfr.pin.mu.Unlock()
+	return cfr.pin.generation
+}
+
+// pinReads returns request with reads pinned to object generation, requests not setting a generation
+// are pinned to generation given stat func returns for their first read
+func (cfr CloudFileRequest) pinReads(ctx context.Context, stat func(context.Context, CloudFileRequest) (ObjectInfo, error)) (CloudFileRequest, error) {
+	if cfr.generation > 0 || cfr.pin == nil {
+		return cfr, nil
+	}
+	cfr.pin.mu.Lock()
+	defer cfr.pin.mu.Unlock()
+
+	if cfr.pin.generation == 0 {
+		info, err := stat(ctx, cfr)
+		if err != nil {
+			return cfr, err
+		}
+		cfr.pin.generation = info.Generation
+		cfr.pin.etag = info.ETag
+	}
+	cfr.generation = cfr.pin.generation
+	return cfr, nil
+}
+
+// pinnedETag returns etag of object generation pinned by first read of request, empty if request didn't pin one
+func (cfr CloudFileRequest) pinnedETag() string {
+	if cfr.pin == nil {
+		return ""
+	}
+	cfr.pin.mu.Lock()
+	defer cfr.pin.mu.Unlock()
+	if cfr.pin.generation != cfr.generation {
+		return ""
+	}
+	return cfr.pin.etag
+}
+
+// objectName returns object name for request filepath
+func (cfr CloudFileRequest) objectName() string {
+	if cfr.path == "" {
+		return cfr.file
+	}
+	return filepath.Join(cfr.path, cfr.file)
+}
+
+// applyAttrs sets request content type, storage class & metadata overrides on given object attributes
+func (cfr CloudFileRequest) applyAttrs(attrs *storage.ObjectAttrs) {
+	if cfr.contentType != "" {
+		attrs.ContentType = cfr.contentType
+	}
+	if cfr.storageClass != "" {
+		attrs.StorageClass = cfr.storageClass
+	}
+	if cfr.metadata != nil {
+		attrs.Metadata = cfr.metadata
+	}
+}
+
+// withTimeout returns context bounded by request timeout, or given client default when request timeout isn't set,
+// caller context when timeout is negative
+func (cfr CloudFileRequest) withTimeout(ctx context.Context, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if cfr.timeout != 0 {
+		timeout = cfr.timeout
+	}
+	if timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// chunkSize returns request upload chunk size, client chunk size when request doesn't set one,
+// zero for storage library default, negative for SingleShot
+func (cs *cloudStorageClient) chunkSize(cfr CloudFileRequest) BufferSize {
+	if cfr.chunkSize != 0 {
+		return cfr.chunkSize
+	}
+	return cs.config.ChunkSize
+}
+
+// copyBuffer returns copy buffer of request buffer size, or client buffer size when request doesn't set one
+func (cs *cloudStorageClient) copyBuffer(cfr CloudFileRequest) []byte {
+	size := cs.config.BufferSize
+	if cfr.bufferSize > 0 {
+		size = cfr.bufferSize
+	}
+	return make([]byte, size)
+}
+
+// isConditional checks if uploads for request are guarded by preconditions
+func (cfr CloudFileRequest) isConditional() bool {
+	return cfr.ifAbsent || cfr.generation > 0 || cfr.metageneration > 0 || cfr.modTime > 0
 }
 
 func (cs *cloudStorageClient) ReadAt(ctx context.Context, cfr CloudFileRequest, p []byte, off int64) (int, error) {
@@ -138,32 +554,38 @@ func (cs *cloudStorageClient) ReadAt(ctx context.Context, cfr CloudFileRequest,
 		fPath = filepath.Join(cfr.path, cfr.file)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// check for object existence
-	obj := cs.client.Bucket(cfr.bucket).Object(fPath)
-	attrs, err := obj.Attrs(ctx)
+	cfr, err := cfr.pinReads(ctx, cs.StatObject)
 	if err != nil {
-		cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
-		return 0, errors.WrapError(err, "cloud file inaccessible %s", fPath)
+		return 0, err
 	}
-	cs.logger.Debug("reading cloud file chunk", zap.String("filepath", fPath), zap.Int64("created", attrs.Created.Unix()), zap.Int64("updated", attrs.Updated.Unix()))
 
-	// open a reader for the object in the bucket
-	rc, err := obj.NewReader(ctx)
-	if err != nil {
-		cs.logger.Error("error reading cloud file", zap.Error(err), zap.String("filepath", fPath))
-		return 0, errors.WrapError(err, "error reading cloud file %s", fPath)
-	}
-	rcReadAt := &GCPStorageReadAtAdaptor{rc}
-	defer func() {
-		if err := rcReadAt.Reader.Close(); err != nil {
-			cs.logger.Error("error closing cloud file reader", zap.Error(err), zap.String("filepath", fPath))
-		}
-	}()
+	ctx, cancel := cfr.withTimeout(ctx, cs.config.TransferTimeout)
+	defer cancel()
 
-	return rcReadAt.ReadAt(p, off)
+	// read only requested byte range
+	cs.logger.Debug("reading cloud file chunk", zap.String("filepath", fPath), zap.Int64("offset", off), zap.Int("length", len(p)))
+	co := newCloudObject(ctx, fPath, -1, cfr.generation, gcsRangeReader(cs.object(cfr.bucket, fPath), cfr.generation))
+	var n int
+	err = cs.retry.retry(ctx, cs.logger, "read", true, func(attempt int) error {
+		var err error
+		n, err = co.ReadAt(p, off)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	if isKind(err, ErrStaleDownload) {
+		cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("filepath", fPath), zap.Int64("generation", cfr.generation))
+		return n, err
+	}
+	if err != nil && err != io.EOF {
+		cs.logger.Error("error reading cloud file", zap.Error(err), zap.String("filepath", fPath), zap.Int64("offset", off))
+		return n, wrapStorageError(err, "error reading cloud file %s", fPath)
+	}
+	return n, err
 }
 
 func (cs *cloudStorageClient) UploadFile(ct context.Context, file io.Reader, cfr CloudFileRequest) (int64, error) {
@@ -175,32 +597,157 @@ func (cs *cloudStorageClient) UploadFile(ct context.Context, file io.Reader, cfr
 		fPath = filepath.Join(cfr.path, cfr.file)
 	}
 
-	ctx, cancel := context.WithTimeout(ct, time.Second*50)
+	ctx, cancel := cfr.withTimeout(ct, cs.config.TransferTimeout)
 	defer cancel()
 
 	// Upload an object with storage.Writer.
-	obj := cs.client.Bucket(cfr.bucket).Object(fPath)
-	attrs, err := obj.Attrs(ctx)
+	obj := cs.object(cfr.bucket, fPath)
+	conds, err := cs.uploadPreconditions(ctx, cfr, fPath)
+	if err != nil {
+		return 0, err
+	}
+	if conds != nil {
+		obj = obj.If(*conds)
+	}
+
+	// retried uploads restart at reader start position, readers that can't seek are uploaded once
+	policy := cs.retry
+	seeker, seekable := file.(io.Seeker)
+	var start int64
+	if seekable {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+	if !seekable {
+		policy.MaxAttempts = 1
+	}
+
+	buf := cs.copyBuffer(cfr)
+	chunkSize := cs.chunkSize(cfr)
+	var nBytes, gen int64
+	err = policy.retry(ctx, cs.logger, "upload", conds != nil, func(attempt int) error {
+		if attempt > 1 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				cs.logger.Error("error rewinding file", zap.Error(err), zap.String("filepath", fPath))
+				return wrapStorageError(err, "error rewinding file %s", fPath)
+			}
+		}
+
+		// on copy error, deferred cancel aborts the upload
+		wCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		wc := obj.NewWriter(wCtx)
+		cfr.applyAttrs(&wc.ObjectAttrs)
+		if chunkSize < 0 {
+			// zero chunk size disables writer chunking & resumable session
+			wc.ChunkSize = 0
+		} else if chunkSize > 0 {
+			wc.ChunkSize = int(chunkSize)
+		}
+		n, err := io.CopyBuffer(wc, file, buf)
+		if err != nil {
+			cs.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", fPath), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error uploading file %s", fPath)
+		}
+
+		// upload is committed, and preconditions checked, on close
+		if err := wc.Close(); err != nil {
+			if isPreconditionFailed(err) {
+				cs.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("filepath", fPath))
+				return kindError(ErrStaleUpload, err)
+			}
+			cs.logger.Error("error closing cloud file", zap.Error(err), zap.String("filepath", fPath), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error closing cloud file %s", fPath)
+		}
+		nBytes, gen = n, wc.Attrs().Generation
+		return nil
+	})
 	if err != nil {
+		return 0, err
+	}
+	cs.logger.Debug("cloud file created/updated", zap.String("filepath", fPath), zap.Int64("generation", gen))
+	return nBytes, nil
+}
+
+// uploadPreconditions checks request preconditions against current object at given filepath,
+// returns write preconditions guarding against replacing newer or concurrently updated objects
+func (cs *cloudStorageClient) uploadPreconditions(ctx context.Context, cfr CloudFileRequest, fPath string) (*storage.Conditions, error) {
+	obj := cs.object(cfr.bucket, fPath)
+	var attrs *storage.ObjectAttrs
+	err := cs.retry.retry(ctx, cs.logger, "stat", true, func(attempt int) error {
+		var err error
+		attrs, err = obj.Attrs(ctx)
+		return err
+	})
+	if err != nil {
+		if !isKind(err, storage.ErrObjectNotExist) && cfr.isConditional() {
+			cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+			return nil, wrapStorageError(err, "cloud file inaccessible %s", fPath)
+		}
 		cs.logger.Debug("cloud file doesn't exist, will create new", zap.String("filepath", fPath))
+		attrs = nil
 	} else {
 		cs.logger.Debug("cloud file exists", zap.Int64("created", attrs.Created.Unix()), zap.Int64("updated", attrs.Updated.Unix()), zap.String("filepath", fPath))
 	}
 
-	wc := obj.NewWriter(ctx)
-	defer func() {
-		if err := wc.Close(); err != nil {
-			cs.logger.Error("error closing cloud file", zap.Error(err), zap.String("filepath", fPath))
+	conds, err := uploadConditions(cfr, attrs)
+	if err != nil {
+		cs.logger.Error(ERROR_STALE_UPLOAD, zap.String("filepath", fPath), zap.Int64("modTime", cfr.modTime), zap.Int64("generation", cfr.generation))
+		return nil, err
+	}
+	return conds, nil
+}
+
+// uploadConditions takes cloud file request & current object attributes, nil if object doesn't exist,
+// returns write preconditions or stale upload error if request conditions already fail
+func uploadConditions(cfr CloudFileRequest, attrs *storage.ObjectAttrs) (*storage.Conditions, error) {
+	var info *ObjectInfo
+	if attrs != nil {
+		objInfo := newObjectInfo(attrs)
+		info = &objInfo
+	}
+	if err := checkUploadConditions(cfr, info); err != nil {
+		return nil, err
+	}
+
+	conds := storage.Conditions{}
+	if c := writeConditions(cfr); c != nil {
+		conds = *c
+	}
+
+	// replace only if remote object, as checked, is still the latest
+	if cfr.modTime > 0 {
+		if attrs == nil {
+			conds.DoesNotExist = true
+		} else if conds.GenerationMatch == 0 {
+			conds.GenerationMatch = attrs.Generation
 		}
-	}()
+	}
 
-	nBytes, err := io.Copy(wc, file)
-	if err != nil {
-		cs.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", fPath))
-		return 0, errors.WrapError(err, "error uploading file %s", fPath)
+	if conds == (storage.Conditions{}) {
+		return nil, nil
 	}
-	cs.logger.Debug("cloud file created/updated", zap.String("filepath", fPath))
-	return nBytes, nil
+	return &conds, nil
+}
+
+// checkUploadConditions takes cloud file request & current object info, nil if object doesn't exist,
+// returns stale upload error if request conditions or modification time don't hold
+func checkUploadConditions(cfr CloudFileRequest, info *ObjectInfo) error {
+	if cfr.ifAbsent && info != nil {
+		return kindError(ErrStaleUpload, nil)
+	}
+	if cfr.generation > 0 && (info == nil || info.Generation != cfr.generation) {
+		return kindError(ErrStaleUpload, nil)
+	}
+	if cfr.metageneration > 0 && (info == nil || info.Metageneration != cfr.metageneration) {
+		return kindError(ErrStaleUpload, nil)
+	}
+	// replace only if remote object is older than request modification time
+	if cfr.modTime > 0 && info != nil && !info.Updated.Before(time.Unix(cfr.modTime, 0)) {
+		return kindError(ErrStaleUpload, nil)
+	}
+	return nil
 }
 
 func (cs *cloudStorageClient) DownloadFile(ct context.Context, file io.Writer, cfr CloudFileRequest) (int64, error) {
@@ -212,61 +759,69 @@ func (cs *cloudStorageClient) DownloadFile(ct context.Context, file io.Writer, c
 		fPath = filepath.Join(cfr.path, cfr.file)
 	}
 
-	ctx, cancel := context.WithTimeout(ct, time.Second*50)
+	ctx, cancel := cfr.withTimeout(ct, cs.config.TransferTimeout)
 	defer cancel()
 
 	// download an object with storage.Reader.
-	obj := cs.client.Bucket(cfr.bucket).Object(fPath)
-	attrs, err := obj.Attrs(ctx)
+	obj := cs.object(cfr.bucket, fPath)
+	var attrs *storage.ObjectAttrs
+	err := cs.retry.retry(ctx, cs.logger, "stat", true, func(attempt int) error {
+		var err error
+		attrs, err = obj.Attrs(ctx)
+		return err
+	})
 	if err != nil {
 		cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
-		return 0, errors.WrapError(err, "cloud file inaccessible %s", fPath)
+		return 0, wrapStorageError(err, "cloud file inaccessible %s", fPath)
+	}
+	if cfr.generation > 0 {
+		if attrs.Generation != cfr.generation {
+			cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("filepath", fPath), zap.Int64("generation", cfr.generation), zap.Int64("current", attrs.Generation))
+			return 0, kindError(ErrStaleDownload, nil)
+		}
+		obj = obj.If(storage.Conditions{GenerationMatch: cfr.generation})
 	}
 	cs.logger.Debug("downloading cloud file", zap.String("filepath", fPath), zap.Int64("created", attrs.Created.Unix()), zap.Int64("updated", attrs.Updated.Unix()))
 
-	rc, err := obj.NewReader(ctx)
-	if err != nil {
-		cs.logger.Error("error reading cloud file", zap.Error(err), zap.String("filepath", fPath))
-		return 0, errors.WrapError(err, "error reading cloud file %s", fPath)
-	}
-	defer func() {
-		if err := rc.Close(); err != nil {
-			cs.logger.Error("error closing cloud file", zap.Error(err), zap.String("filepath", fPath))
+	// retried downloads resume at copied offset, pinned to generation read first
+	buf := cs.copyBuffer(cfr)
+	var nBytes, gen int64
+	err = cs.retry.retry(ctx, cs.logger, "download", true, func(attempt int) error {
+		rObj := obj
+		if gen > 0 {
+			rObj = obj.Generation(gen)
 		}
-	}()
+		rc, err := rObj.NewRangeReader(ctx, nBytes, -1)
+		if err != nil {
+			if (cfr.generation > 0 || gen > 0) && (isPreconditionFailed(err) || isKind(err, storage.ErrObjectNotExist)) {
+				cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("filepath", fPath), zap.Int64("generation", cfr.generation))
+				return kindError(ErrStaleDownload, err)
+			}
+			cs.logger.Error("error reading cloud file", zap.Error(err), zap.String("filepath", fPath), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error reading cloud file %s", fPath)
+		}
+		defer func() {
+			if err := rc.Close(); err != nil {
+				cs.logger.Error("error closing cloud file", zap.Error(err), zap.String("filepath", fPath))
+			}
+		}()
+		gen = rc.Attrs.Generation
 
-	nBytes, err := io.Copy(file, rc)
+		n, err := io.CopyBuffer(file, rc, buf)
+		nBytes += n
+		if err != nil {
+			cs.logger.Error("error copying cloud file", zap.Error(err), zap.String("filepath", fPath), zap.Int64("offset", nBytes), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error copying cloud file %s", fPath)
+		}
+		return nil
+	})
 	if err != nil {
-		cs.logger.Error("error copying cloud file", zap.Error(err), zap.String("filepath", fPath))
-		return 0, errors.WrapError(err, "error copying cloud file %s", fPath)
+		return 0, err
 	}
 
 	return nBytes, nil
 }
 
-func (cs *cloudStorageClient) ListObjects(ctx context.Context, req CloudFileRequest) ([]string, error) {
-	if req.bucket == "" {
-		return nil, ErrBucketNameMissing
-	}
-
-	bucket := cs.client.Bucket(req.bucket)
-	it := bucket.Objects(ctx, nil)
-	names := []string{}
-	for {
-		objAttrs, err := it.Next()
-		if err != nil {
-			if err == iterator.Done {
-				break
-			} else {
-				cs.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err))
-				return names, errors.WrapError(err, ERROR_LISTING_OBJECTS)
-			}
-		}
-		names = append(names, objAttrs.Name)
-	}
-	return names, nil
-}
-
 func (cs *cloudStorageClient) DeleteObject(ctx context.Context, req CloudFileRequest) error {
 	if req.bucket == "" {
 		return ErrBucketNameMissing
@@ -278,37 +833,18 @@ func (cs *cloudStorageClient) DeleteObject(ctx context.Context, req CloudFileReq
 		return ErrFileNameMissing
 	}
 
-	bucket := cs.client.Bucket(req.bucket)
-	objName := fmt.Sprintf("%s/%s", req.path, req.file)
+	ctx, cancel := req.withTimeout(ctx, cs.config.MetadataTimeout)
+	defer cancel()
 
-	if err := bucket.Object(objName).Delete(ctx); err != nil {
-		cs.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err))
-		return errors.WrapError(err, ERROR_DELETING_OBJECT)
-	}
-	return nil
-}
+	objName := req.objectName()
 
-func (cs *cloudStorageClient) DeleteObjects(ctx context.Context, req CloudFileRequest) error {
-	if req.bucket == "" {
-		return ErrBucketNameMissing
-	}
-	bucket := cs.client.Bucket(req.bucket)
-	it := bucket.Objects(ctx, nil)
-	for {
-		objAttrs, err := it.Next()
-		if err != nil {
-			if err == iterator.Done {
-				break
-			} else {
-				cs.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err))
-				return errors.WrapError(err, ERROR_LISTING_OBJECTS)
-			}
-		}
-		cs.logger.Info("object attributes", zap.Any("objAttrs", objAttrs))
-		if err := bucket.Object(objAttrs.Name).Delete(ctx); err != nil {
-			cs.logger.Error(ERROR_DELETING_OBJECTS, zap.Error(err))
-			return errors.WrapError(err, ERROR_DELETING_OBJECTS)
-		}
+	// unconditional deletes aren't idempotent, a retry may find the object already deleted
+	err := cs.retry.retry(ctx, cs.logger, "delete", false, func(attempt int) error {
+		return cs.object(req.bucket, objName).Delete(ctx)
+	})
+	if err != nil {
+		cs.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err))
+		return wrapStorageError(err, ERROR_DELETING_OBJECT)
 	}
 	return nil
 }
@@ -317,7 +853,7 @@ func (cs *cloudStorageClient) Close() error {
 	err := cs.client.Close()
 	if err != nil {
 		cs.logger.Error("error closing storage client", zap.Error(err))
-		return errors.WrapError(err, "error closing storage client")
+		return wrapStorageError(err, "error closing storage client")
 	}
 	return nil
 }
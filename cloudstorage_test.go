@@ -10,10 +10,12 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/comfforts/errors"
 	"github.com/comfforts/logger"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 )
 
 type testConfig struct {
@@ -36,17 +38,48 @@ func getTestConfig() testConfig {
 
 type JSONMapper = map[string]interface{}
 
-func TestCloudFileStorage(t *testing.T) {
-	for scenario, fn := range map[string]func(
-		t *testing.T,
-		client CloudStorage,
-		testCfg testConfig,
-	){
+type storageScenario = func(t *testing.T, client CloudStorage, testCfg testConfig)
+
+// storageScenarios returns backend agnostic storage test scenarios
+func storageScenarios() map[string]storageScenario {
+	return map[string]storageScenario{
 		"list objects succeeds":                   testListObjects,
 		"file upload & delete succeeds":           testUploadDelete,
 		"file upload, download & delete succeeds": testUploadDownloadDelete,
 		"file download, succeeds":                 testDownloadFile,
-	} {
+		"open object, read & seek succeeds":       testOpenObject,
+		"ranged read at succeeds":                 testReadAtRanges,
+		"pinned read of replaced object fails":    testPinnedReadStale,
+		"conditional upload conflicts fail":       testConditionalUpload,
+		"prefix delete with dry run succeeds":     testDeleteObjects,
+		"delimited prefix delete keeps nested":    testDeleteObjectsDelimited,
+		"copy & move object succeeds":             testCopyMoveObject,
+	}
+}
+
+// runStorageScenarios runs storage scenarios not needing a preexisting cloud file, each against a client
+// set up with a temp dir test config. Setup may adjust test config & returns client with its teardown
+func runStorageScenarios(t *testing.T, setup func(t *testing.T, testCfg *testConfig) (CloudStorage, func())) {
+	for scenario, fn := range storageScenarios() {
+		// needs a preexisting cloud file
+		if scenario == "file download, succeeds" {
+			continue
+		}
+		fn := fn
+		t.Run(scenario, func(t *testing.T) {
+			testCfg := testConfig{
+				dir:    t.TempDir(),
+				bucket: "test-bucket",
+			}
+			client, teardown := setup(t, &testCfg)
+			defer teardown()
+			fn(t, client, testCfg)
+		})
+	}
+}
+
+func TestCloudFileStorage(t *testing.T) {
+	for scenario, fn := range storageScenarios() {
 		testCfg := getTestConfig()
 		t.Run(scenario, func(t *testing.T) {
 			client, teardown := setupCloudTest(t, testCfg)
@@ -83,6 +116,105 @@ func setupCloudTest(t *testing.T, testCfg testConfig) (
 	}
 }
 
+func TestCloudStorageClientCredentials(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+
+	// clients with different credentials coexist, process environment is left alone
+	for _, token := range []string{"token-a", "token-b"} {
+		csc, err := NewCloudStorageClient(CloudStorageClientConfig{
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+		}, appLogger)
+		require.NoError(t, err)
+		require.Equal(t, "", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+		require.NoError(t, csc.Close())
+	}
+
+	_, err := NewCloudStorageClient(CloudStorageClientConfig{
+		CredsPath: "creds/valid-creds.json",
+		CredsJSON: []byte(`{"type": "service_account"}`),
+	}, appLogger)
+	require.ErrorIs(t, err, ErrConflictingCredentials)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfr, err := NewCloudFileRequest("test-bucket", "data.json", "timeout", 0)
+	require.NoError(t, err)
+	tCtx, tCancel := cfr.withTimeout(ctx, DEFAULT_METADATA_TIMEOUT)
+	deadline, ok := tCtx.Deadline()
+	require.Equal(t, true, ok)
+	require.Equal(t, true, time.Until(deadline) <= DEFAULT_METADATA_TIMEOUT)
+	tCancel()
+
+	cfr, err = NewCloudFileRequest("test-bucket", "data.json", "timeout", 0, WithTimeout(time.Millisecond))
+	require.NoError(t, err)
+	tCtx, tCancel = cfr.withTimeout(ctx, DEFAULT_TRANSFER_TIMEOUT)
+	<-tCtx.Done()
+	require.ErrorIs(t, tCtx.Err(), context.DeadlineExceeded)
+	tCancel()
+
+	// caller context only, by request override or client default
+	cfr, err = NewCloudFileRequest("test-bucket", "data.json", "timeout", 0, WithTimeout(NoTimeout))
+	require.NoError(t, err)
+	tCtx, tCancel = cfr.withTimeout(ctx, DEFAULT_TRANSFER_TIMEOUT)
+	_, ok = tCtx.Deadline()
+	require.Equal(t, false, ok)
+	tCancel()
+
+	cfr, err = NewCloudFileRequest("test-bucket", "data.json", "timeout", 0)
+	require.NoError(t, err)
+	tCtx, tCancel = cfr.withTimeout(ctx, NoTimeout)
+	_, ok = tCtx.Deadline()
+	require.Equal(t, false, ok)
+	tCancel()
+}
+
+func TestBufferSizes(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+
+	client, err := NewCloudStorageClient(CloudStorageClientConfig{Endpoint: "localhost:4443", Anonymous: true}, appLogger)
+	require.NoError(t, err)
+	defer func() {
+		err := client.Close()
+		require.NoError(t, err)
+	}()
+	cfr, err := NewCloudFileRequest("test-bucket", "data.json", "buffers", 0)
+	require.NoError(t, err)
+	require.Equal(t, BufferSize(0), client.chunkSize(cfr))
+	require.Equal(t, int(DEFAULT_BUFFER_SIZE), len(client.copyBuffer(cfr)))
+	require.Equal(t, DEFAULT_RESUMABLE_CHUNK_SIZE, client.resumableChunkSize(cfr))
+
+	sized, err := NewCloudStorageClient(CloudStorageClientConfig{
+		Endpoint:   "localhost:4443",
+		Anonymous:  true,
+		ChunkSize:  EightMB,
+		BufferSize: OneKB,
+	}, appLogger)
+	require.NoError(t, err)
+	defer func() {
+		err := sized.Close()
+		require.NoError(t, err)
+	}()
+	require.Equal(t, EightMB, sized.chunkSize(cfr))
+	require.Equal(t, int(OneKB), len(sized.copyBuffer(cfr)))
+	require.Equal(t, int64(EightMB), sized.resumableChunkSize(cfr))
+
+	// request sizes override client sizes
+	cfr, err = NewCloudFileRequest("test-bucket", "data.json", "buffers", 0, WithChunkSize(SingleShot), WithBufferSize(ThirtyTwoKB))
+	require.NoError(t, err)
+	require.Equal(t, SingleShot, sized.chunkSize(cfr))
+	require.Equal(t, int(ThirtyTwoKB), len(sized.copyBuffer(cfr)))
+	require.Equal(t, DEFAULT_RESUMABLE_CHUNK_SIZE, sized.resumableChunkSize(cfr))
+
+	cfr, err = NewCloudFileRequest("test-bucket", "data.json", "buffers", 0, WithChunkSize(TwoFiftySixKB+1))
+	require.NoError(t, err)
+	require.Equal(t, int64(2*TwoFiftySixKB), sized.resumableChunkSize(cfr))
+}
+
 func testUploadDelete(t *testing.T, client CloudStorage, testCfg testConfig) {
 	name := "testUpDe"
 	filePath, err := createJSONFile(testCfg.dir, name)
@@ -182,14 +314,374 @@ func testListObjects(t *testing.T, client CloudStorage, testCfg testConfig) {
 	t.Logf(" testUpload: %d bytes written", n)
 	require.Equal(t, true, n > 0)
 
-	names, err := client.ListObjects(ctx, cfr)
+	list, err := client.ListObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, true, len(list.Objects) > 0)
+
+	globCfr, err := NewCloudFileRequest(testCfg.bucket, "", testCfg.dir, 0, WithGlob(fmt.Sprintf("%s/tes?.json", testCfg.dir)), WithDelimiter("/"))
+	require.NoError(t, err)
+	list, err = client.ListObjects(ctx, globCfr)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list.Objects))
+	require.Equal(t, n, list.Objects[0].Size)
+
+	page, err := client.ListObjectsPage(ctx, cfr, 1, "")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page.Objects))
+
+	streamCnt := 0
+	for entry := range client.StreamObjects(ctx, cfr) {
+		require.NoError(t, entry.Err)
+		streamCnt++
+	}
+	require.Equal(t, true, streamCnt > 0)
+
+	err = client.DeleteObject(ctx, cfr)
+	require.NoError(t, err)
+}
+
+func testOpenObject(t *testing.T, client CloudStorage, testCfg testConfig) {
+	name := "testOpen"
+	filePath, err := createJSONFile(testCfg.dir, name)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0)
+	require.NoError(t, err)
+
+	n, err := client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	obj, err := client.OpenObject(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), obj.Size())
+
+	info, err := client.StatObject(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+	require.Equal(t, obj.Generation(), info.Generation)
+
+	buf := make([]byte, 10)
+	nRead, err := obj.ReadAt(buf, 5)
+	require.NoError(t, err)
+	require.Equal(t, data[5:15], buf[:nRead])
+
+	// read past end returns available bytes with io.EOF
+	nRead, err = obj.ReadAt(buf, int64(len(data)-4))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, data[len(data)-4:], buf[:nRead])
+
+	off, err := obj.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)-10), off)
+	tail, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	require.Equal(t, data[len(data)-10:], tail)
+
+	// closed handle reads fail
+	err = obj.Close()
+	require.NoError(t, err)
+	_, err = obj.ReadAt(buf, 0)
+	require.ErrorIs(t, err, ErrObjectClosed)
+	_, err = obj.Read(buf)
+	require.ErrorIs(t, err, ErrObjectClosed)
+
+	err = client.DeleteObject(ctx, cfr)
+	require.NoError(t, err)
+}
+
+func testReadAtRanges(t *testing.T, client CloudStorage, testCfg testConfig) {
+	name := "testReadAt"
+	filePath, err := createJSONFile(testCfg.dir, name)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filePath)
 	require.NoError(t, err)
-	require.Equal(t, true, len(names) > 0)
+	require.Equal(t, true, len(data) > 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0)
+	require.NoError(t, err)
+
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+
+	size := int64(len(data))
+	tests := []struct {
+		name string
+		off  int64
+		len  int
+		want []byte
+		err  error
+	}{
+		{name: "buffer filled within object", off: 5, len: 10, want: data[5:15]},
+		{name: "buffer filled up to object end", off: size - 10, len: 10, want: data[size-10:]},
+		{name: "short read at object end returns io.EOF", off: size - 4, len: 10, want: data[size-4:], err: io.EOF},
+		{name: "offset past object end returns io.EOF", off: size + 10, len: 10, want: []byte{}, err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.len)
+			n, err := client.ReadAt(ctx, cfr, buf, tt.off)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.want, buf[:n])
+		})
+	}
 
 	err = client.DeleteObject(ctx, cfr)
 	require.NoError(t, err)
 }
 
+func testPinnedReadStale(t *testing.T, client CloudStorage, testCfg testConfig) {
+	name := "testPinned"
+	filePath, err := createJSONFile(testCfg.dir, name)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0)
+	require.NoError(t, err)
+
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+
+	obj, err := client.OpenObject(ctx, cfr)
+	require.NoError(t, err)
+	defer func() {
+		err := obj.Close()
+		require.NoError(t, err)
+	}()
+
+	buf := make([]byte, 10)
+	_, err = obj.ReadAt(buf, 0)
+	require.NoError(t, err)
+
+	pinnedCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0, WithGeneration(obj.Generation()))
+	require.NoError(t, err)
+
+	// first read pins request to current generation
+	readCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0)
+	require.NoError(t, err)
+	_, err = client.ReadAt(ctx, readCfr, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, obj.Generation(), readCfr.Generation())
+
+	// replace object mid-read
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+
+	_, err = obj.ReadAt(buf, 10)
+	require.ErrorIs(t, err, ErrStaleDownload)
+
+	_, err = client.ReadAt(ctx, pinnedCfr, buf, 10)
+	require.ErrorIs(t, err, ErrStaleDownload)
+
+	_, err = client.ReadAt(ctx, readCfr, buf, 10)
+	require.ErrorIs(t, err, ErrStaleDownload)
+
+	// new requests read replacement
+	readCfr, err = NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0)
+	require.NoError(t, err)
+	n, err := client.ReadAt(ctx, readCfr, buf, 10)
+	require.NoError(t, err)
+	require.Equal(t, data[10:10+n], buf[:n])
+
+	err = client.DeleteObject(ctx, cfr)
+	require.NoError(t, err)
+}
+
+func testConditionalUpload(t *testing.T, client CloudStorage, testCfg testConfig) {
+	name := "testCondUp"
+	filePath, err := createJSONFile(testCfg.dir, name)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	createCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0, WithIfAbsent())
+	require.NoError(t, err)
+
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), createCfr)
+	require.NoError(t, err)
+
+	// object exists now
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), createCfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+
+	obj, err := client.OpenObject(ctx, createCfr)
+	require.NoError(t, err)
+	gen := obj.Generation()
+	err = obj.Close()
+	require.NoError(t, err)
+
+	genCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0, WithGeneration(gen))
+	require.NoError(t, err)
+
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), genCfr)
+	require.NoError(t, err)
+
+	// generation moved on with last upload
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), genCfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+
+	// remote object is newer than local modification time
+	modCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 1)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), modCfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+
+	err = client.DeleteObject(ctx, createCfr)
+	require.NoError(t, err)
+}
+
+func testDeleteObjects(t *testing.T, client CloudStorage, testCfg testConfig) {
+	dataDir := fmt.Sprintf("%s/%s", testCfg.dir, "cleanup")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, name := range []string{"testDelA", "testDelB"} {
+		filePath, err := createJSONFile(dataDir, name)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(filePath)
+		require.NoError(t, err)
+
+		cfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), dataDir, 0)
+		require.NoError(t, err)
+		_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+		require.NoError(t, err)
+	}
+
+	// bucket wide delete needs explicit opt in
+	bktCfr, err := NewCloudFileRequest(testCfg.bucket, "", "", 0)
+	require.NoError(t, err)
+	_, err = client.DeleteObjects(ctx, bktCfr)
+	require.ErrorIs(t, err, ErrDeletePrefixMissing)
+
+	dryCfr, err := NewCloudFileRequest(testCfg.bucket, "", dataDir, 0, WithDryRun())
+	require.NoError(t, err)
+	summary, err := client.DeleteObjects(ctx, dryCfr)
+	require.NoError(t, err)
+	require.Equal(t, true, summary.DryRun)
+	require.Equal(t, 2, len(summary.Deleted))
+
+	cfr, err := NewCloudFileRequest(testCfg.bucket, "", dataDir, 0, WithConcurrency(2))
+	require.NoError(t, err)
+	summary, err = client.DeleteObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(summary.Deleted))
+	require.Equal(t, 0, len(summary.Failed))
+	for _, result := range summary.Results {
+		require.Equal(t, DeleteStatusDeleted, result.Status)
+	}
+
+	list, err := client.ListObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(list.Objects))
+}
+
+func testDeleteObjectsDelimited(t *testing.T, client CloudStorage, testCfg testConfig) {
+	dataDir := fmt.Sprintf("%s/%s", testCfg.dir, "delimited")
+	nestedDir := fmt.Sprintf("%s/%s", dataDir, "nested")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, dir := range []string{dataDir, nestedDir} {
+		filePath, err := createJSONFile(dir, "testDel")
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(filePath)
+		require.NoError(t, err)
+
+		cfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), dir, 0)
+		require.NoError(t, err)
+		_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+		require.NoError(t, err)
+	}
+
+	// delimited delete removes top level objects only
+	cfr, err := NewCloudFileRequest(testCfg.bucket, "", dataDir, 0, WithDelimiter("/"))
+	require.NoError(t, err)
+	summary, err := client.DeleteObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, []string{fmt.Sprintf("%s/%s", dataDir, "testDel.json")}, summary.Deleted)
+
+	allCfr, err := NewCloudFileRequest(testCfg.bucket, "", dataDir, 0)
+	require.NoError(t, err)
+	list, err := client.ListObjects(ctx, allCfr)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list.Objects))
+	require.Equal(t, fmt.Sprintf("%s/%s", nestedDir, "testDel.json"), list.Objects[0].Name)
+
+	summary, err = client.DeleteObjects(ctx, allCfr)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(summary.Deleted))
+}
+
+func testCopyMoveObject(t *testing.T, client CloudStorage, testCfg testConfig) {
+	name := "testCopy"
+	filePath, err := createJSONFile(testCfg.dir, name)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srcCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), testCfg.dir, 0)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), srcCfr)
+	require.NoError(t, err)
+
+	copyDir := fmt.Sprintf("%s/%s", testCfg.dir, "published")
+	copyCfr, err := NewCloudFileRequest(testCfg.bucket, filepath.Base(filePath), copyDir, 0, WithContentType("application/json"), WithIfAbsent())
+	require.NoError(t, err)
+	info, err := client.CopyObject(ctx, srcCfr, copyCfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+	require.Equal(t, "application/json", info.ContentType)
+
+	// destination exists now
+	_, err = client.CopyObject(ctx, srcCfr, copyCfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+
+	moveCfr, err := NewCloudFileRequest(testCfg.bucket, fmt.Sprintf("%s-moved.json", name), copyDir, 0)
+	require.NoError(t, err)
+	info, err = client.MoveObject(ctx, srcCfr, moveCfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+
+	_, err = client.StatObject(ctx, srcCfr)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+
+	for _, cfr := range []CloudFileRequest{copyCfr, moveCfr} {
+		err = client.DeleteObject(ctx, cfr)
+		require.NoError(t, err)
+	}
+}
+
 func createDirectory(path string) error {
 	_, err := os.Stat(filepath.Dir(path))
 	if err != nil {
@@ -0,0 +1,141 @@
+package cloudstorage
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+)
+
+func (cs *cloudStorageClient) CopyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	ctx, cancel := dst.withTimeout(ctx, cs.config.TransferTimeout)
+	defer cancel()
+
+	info, _, err := cs.copyObject(ctx, src, dst)
+	return info, err
+}
+
+func (cs *cloudStorageClient) MoveObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	ctx, cancel := dst.withTimeout(ctx, cs.config.TransferTimeout)
+	defer cancel()
+
+	info, srcGen, err := cs.copyObject(ctx, src, dst)
+	if err != nil {
+		return info, err
+	}
+
+	// move onto itself rewrites attributes only
+	srcName := src.objectName()
+	if src.bucket == dst.bucket && srcName == info.Name {
+		return info, nil
+	}
+
+	// delete only copied source generation
+	srcObj := cs.object(src.bucket, srcName).If(storage.Conditions{GenerationMatch: srcGen})
+	err = cs.retry.retry(ctx, cs.logger, "delete", true, func(attempt int) error {
+		return srcObj.Delete(ctx)
+	})
+	if err != nil {
+		if isPreconditionFailed(err) {
+			cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.Error(err), zap.String("src", srcName), zap.Int64("generation", srcGen))
+			cs.rollbackCopy(ctx, info)
+			return ObjectInfo{}, kindError(ErrStaleDownload, err)
+		}
+		cs.logger.Error(ERROR_MOVING_OBJECT, zap.Error(err), zap.String("src", srcName))
+		return info, wrapStorageError(err, ERROR_MOVING_OBJECT)
+	}
+	cs.logger.Debug("moved cloud file", zap.String("src", srcName), zap.String("dst", info.Name))
+	return info, nil
+}
+
+// rollbackCopy deletes copied destination generation of a failed move, leaving replaced destinations alone
+func (cs *cloudStorageClient) rollbackCopy(ctx context.Context, info ObjectInfo) {
+	dstObj := cs.object(info.Bucket, info.Name).If(storage.Conditions{GenerationMatch: info.Generation})
+	err := cs.retry.retry(ctx, cs.logger, "delete", true, func(attempt int) error {
+		return dstObj.Delete(ctx)
+	})
+	if err != nil {
+		cs.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("dst", info.Name), zap.Int64("generation", info.Generation))
+	}
+}
+
+// copyObject copies source to destination, pinned to source generation at copy start,
+// returns destination object info & copied source generation
+func (cs *cloudStorageClient) copyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, int64, error) {
+	if src.bucket == "" || dst.bucket == "" {
+		return ObjectInfo{}, 0, ErrBucketNameMissing
+	}
+	if src.file == "" || dst.file == "" {
+		return ObjectInfo{}, 0, ErrFileNameMissing
+	}
+
+	srcName, dstName := src.objectName(), dst.objectName()
+	srcObj := cs.object(src.bucket, srcName)
+	var srcAttrs *storage.ObjectAttrs
+	err := cs.retry.retry(ctx, cs.logger, "stat", true, func(attempt int) error {
+		var err error
+		srcAttrs, err = srcObj.Attrs(ctx)
+		return err
+	})
+	if err != nil {
+		cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", srcName))
+		return ObjectInfo{}, 0, wrapStorageError(err, "cloud file inaccessible %s", srcName)
+	}
+	if src.generation > 0 && srcAttrs.Generation != src.generation {
+		cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("src", srcName), zap.Int64("generation", src.generation), zap.Int64("current", srcAttrs.Generation))
+		return ObjectInfo{}, 0, kindError(ErrStaleDownload, nil)
+	}
+	srcObj = srcObj.Generation(srcAttrs.Generation)
+
+	dstObj := cs.object(dst.bucket, dstName)
+	conds := writeConditions(dst)
+	if conds != nil {
+		dstObj = dstObj.If(*conds)
+	}
+
+	copier := dstObj.CopierFrom(srcObj)
+	// keep source attributes for fields not overridden
+	copier.ContentType = srcAttrs.ContentType
+	copier.ContentEncoding = srcAttrs.ContentEncoding
+	copier.ContentLanguage = srcAttrs.ContentLanguage
+	copier.ContentDisposition = srcAttrs.ContentDisposition
+	copier.CacheControl = srcAttrs.CacheControl
+	copier.StorageClass = srcAttrs.StorageClass
+	copier.Metadata = srcAttrs.Metadata
+	dst.applyAttrs(&copier.ObjectAttrs)
+
+	// copies guarded by destination preconditions are idempotent
+	var attrs *storage.ObjectAttrs
+	err = cs.retry.retry(ctx, cs.logger, "copy", conds != nil, func(attempt int) error {
+		var err error
+		attrs, err = copier.Run(ctx)
+		return err
+	})
+	if err != nil {
+		if isPreconditionFailed(err) {
+			cs.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+			return ObjectInfo{}, 0, kindError(ErrStaleUpload, err)
+		}
+		cs.logger.Error(ERROR_COPYING_OBJECT, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+		return ObjectInfo{}, 0, wrapStorageError(err, ERROR_COPYING_OBJECT)
+	}
+	cs.logger.Debug("copied cloud file", zap.String("src", srcName), zap.String("dst", dstName), zap.Int64("generation", attrs.Generation))
+	return newObjectInfo(attrs), srcAttrs.Generation, nil
+}
+
+// writeConditions returns write preconditions set on request, nil if none
+func writeConditions(cfr CloudFileRequest) *storage.Conditions {
+	conds := storage.Conditions{}
+	if cfr.ifAbsent {
+		conds.DoesNotExist = true
+	} else if cfr.generation > 0 {
+		conds.GenerationMatch = cfr.generation
+	}
+	if cfr.metageneration > 0 {
+		conds.MetagenerationMatch = cfr.metageneration
+	}
+	if conds == (storage.Conditions{}) {
+		return nil
+	}
+	return &conds
+}
@@ -0,0 +1,211 @@
+package cloudstorage
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+const DEFAULT_DELETE_WORKERS = 10
+
+// DeleteStatus is outcome of a single object delete
+type DeleteStatus string
+
+const (
+	DeleteStatusDeleted            DeleteStatus = "deleted"
+	DeleteStatusNotFound           DeleteStatus = "not found"
+	DeleteStatusPreconditionFailed DeleteStatus = "precondition failed"
+	DeleteStatusFailed             DeleteStatus = "failed"
+)
+
+// DeleteResult holds delete outcome for an object key
+type DeleteResult struct {
+	Key    string
+	Status DeleteStatus
+	Err    error
+}
+
+// DeleteSummary holds keys deleted, or to be deleted in dry run, keys failed to delete
+// & per key delete results
+type DeleteSummary struct {
+	DryRun  bool
+	Deleted []string
+	Failed  []string
+	Results []DeleteResult
+}
+
+// add records delete result, tallying deleted & failed keys, objects not found count as neither
+func (ds *DeleteSummary) add(result DeleteResult) {
+	ds.Results = append(ds.Results, result)
+	switch result.Status {
+	case DeleteStatusDeleted:
+		ds.Deleted = append(ds.Deleted, result.Key)
+	case DeleteStatusNotFound:
+	default:
+		ds.Failed = append(ds.Failed, result.Key)
+	}
+}
+
+// WithDryRun lists objects to be deleted without deleting them
+func WithDryRun() CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.dryRun = true
+	}
+}
+
+// WithDeleteAll allows deleting all bucket objects when request path is empty
+func WithDeleteAll() CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.deleteAll = true
+	}
+}
+
+// WithConcurrency sets number of concurrent workers for batch operations
+func WithConcurrency(workers int) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.concurrency = workers
+	}
+}
+
+// DeleteObjects deletes objects under request prefix with a bounded worker pool,
+// continues past individual failures & returns incomplete delete error if any object failed
+func (cs *cloudStorageClient) DeleteObjects(ctx context.Context, req CloudFileRequest) (DeleteSummary, error) {
+	if err := req.validateList(); err != nil {
+		return DeleteSummary{}, err
+	}
+	// guard against wiping entire bucket
+	if req.path == "" && !req.deleteAll {
+		return DeleteSummary{}, ErrDeletePrefixMissing
+	}
+
+	bucket := cs.client.Bucket(req.bucket)
+	summary, listErr := deleteObjectInfos(ctx, req, func(infoStream chan<- ObjectInfo) error {
+		return cs.feedListedObjects(ctx, bucket, req, infoStream)
+	}, func(ctx context.Context, info ObjectInfo) DeleteResult {
+		return cs.deleteListedObject(ctx, bucket, info)
+	})
+	if listErr != nil {
+		return summary, listErr
+	}
+	cs.logger.Info("deleted objects", zap.String("prefix", req.listPrefix()), zap.Bool("dryRun", req.dryRun), zap.Int("deleted", len(summary.Deleted)), zap.Int("failed", len(summary.Failed)))
+	if len(summary.Failed) > 0 {
+		return summary, ErrDeleteIncomplete
+	}
+	return summary, nil
+}
+
+// feedListedObjects sends objects listed for request to given stream, until listing is done or fails
+func (cs *cloudStorageClient) feedListedObjects(ctx context.Context, bucket *storage.BucketHandle, req CloudFileRequest, infoStream chan<- ObjectInfo) error {
+	it := bucket.Objects(ctx, req.listQuery())
+	for {
+		objAttrs, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				return nil
+			}
+			cs.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+			return wrapStorageError(err, ERROR_LISTING_OBJECTS)
+		}
+		if objAttrs.Prefix != "" || !req.matchGlob(objAttrs.Name) {
+			continue
+		}
+
+		select {
+		case infoStream <- newObjectInfo(objAttrs):
+		case <-ctx.Done():
+			return wrapStorageError(ctx.Err(), ERROR_LISTING_OBJECTS)
+		}
+	}
+}
+
+// deleteListedObject deletes listed object generation, returns delete result
+func (cs *cloudStorageClient) deleteListedObject(ctx context.Context, bucket *storage.BucketHandle, info ObjectInfo) DeleteResult {
+	result := DeleteResult{
+		Key: info.Name,
+	}
+
+	// delete only listed generation, skip objects replaced since listing
+	obj := bucket.Object(info.Name).Retryer(storage.WithPolicy(storage.RetryNever)).If(storage.Conditions{GenerationMatch: info.Generation})
+	err := cs.retry.retry(ctx, cs.logger, "delete", true, func(attempt int) error {
+		return obj.Delete(ctx)
+	})
+	switch {
+	case err == nil:
+		cs.logger.Debug("deleted object", zap.String("name", info.Name), zap.Int64("generation", info.Generation))
+		result.Status = DeleteStatusDeleted
+	case isKind(err, storage.ErrObjectNotExist):
+		result.Status = DeleteStatusNotFound
+		result.Err = kindError(ErrObjectNotFound, err)
+	case isPreconditionFailed(err):
+		cs.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", info.Name))
+		result.Status = DeleteStatusPreconditionFailed
+		result.Err = kindError(ErrPreconditionFailed, err)
+	default:
+		cs.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", info.Name))
+		result.Status = DeleteStatusFailed
+		result.Err = wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	return result
+}
+
+// deleteObjectInfos deletes objects sent by given feed func with a bounded worker pool using given delete func,
+// dry run reports objects as deleted without deleting them. Returns summary of objects fed & feed error
+func deleteObjectInfos(ctx context.Context, req CloudFileRequest, feed func(infoStream chan<- ObjectInfo) error, deleteFn func(context.Context, ObjectInfo) DeleteResult) (DeleteSummary, error) {
+	workers := req.concurrency
+	if workers <= 0 {
+		workers = DEFAULT_DELETE_WORKERS
+	}
+
+	summary := DeleteSummary{
+		DryRun:  req.dryRun,
+		Deleted: []string{},
+		Failed:  []string{},
+		Results: []DeleteResult{},
+	}
+
+	infoStream := make(chan ObjectInfo)
+	resultStream := make(chan DeleteResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for info := range infoStream {
+				if req.dryRun {
+					resultStream <- DeleteResult{Key: info.Name, Status: DeleteStatusDeleted}
+					continue
+				}
+				resultStream <- deleteFn(ctx, info)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for result := range resultStream {
+			summary.add(result)
+		}
+	}()
+
+	feedErr := feed(infoStream)
+	close(infoStream)
+	wg.Wait()
+	close(resultStream)
+	<-done
+	return summary, feedErr
+}
+
+// feedObjectInfos returns feed func sending given listed objects
+func feedObjectInfos(infos []ObjectInfo) func(infoStream chan<- ObjectInfo) error {
+	return func(infoStream chan<- ObjectInfo) error {
+		for _, info := range infos {
+			infoStream <- info
+		}
+		return nil
+	}
+}
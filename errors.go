@@ -0,0 +1,168 @@
+package cloudstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// StorageError is a classified storage failure,
+// matches its kind sentinel with errors.Is & unwraps to underlying provider error
+type StorageError struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+func (e *StorageError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches error kind, stale errors are precondition failures & also match ErrStale
+func (e *StorageError) Is(target error) bool {
+	if e.Kind == nil {
+		return false
+	}
+	if target == e.Kind {
+		return true
+	}
+	if e.Kind == ErrStaleUpload || e.Kind == ErrStaleDownload {
+		return target == ErrStale || target == ErrPreconditionFailed
+	}
+	return false
+}
+
+// wrapStorageError wraps provider error with message, classified by error kind
+func wrapStorageError(err error, msg string, args ...interface{}) error {
+	return &StorageError{
+		Kind:    errorKind(err),
+		Message: fmt.Sprintf(msg, args...),
+		Err:     err,
+	}
+}
+
+// kindError returns storage error of given kind, wrapping cause if any
+func kindError(kind, err error) error {
+	return &StorageError{
+		Kind:    kind,
+		Message: kind.Error(),
+		Err:     err,
+	}
+}
+
+// isKind checks if error matches given error kind
+func isKind(err, kind error) bool {
+	return errors.Is(err, kind)
+}
+
+// errorKind classifies provider error, returns kind sentinel or nil if unclassified
+func errorKind(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var sErr *StorageError
+	if errors.As(err, &sErr) && sErr.Kind != nil {
+		return sErr.Kind
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return ErrObjectNotFound
+	case errors.Is(err, storage.ErrBucketNotExist):
+		return ErrBucketNotFound
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrObjectNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPermissionDenied
+	case errors.Is(err, context.Canceled):
+		return ErrCanceled
+	// timed out attempts are retried, retries stop once caller context is done
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrTransient
+	}
+
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return statusKind(gErr.Code)
+	}
+
+	var rErr *responseError
+	if errors.As(err, &rErr) {
+		if rErr.StatusCode == http.StatusNotFound && (rErr.Code == "NoSuchBucket" || rErr.Code == "ContainerNotFound") {
+			return ErrBucketNotFound
+		}
+		return statusKind(rErr.StatusCode)
+	}
+
+	var nErr net.Error
+	if errors.As(err, &nErr) {
+		return ErrTransient
+	}
+	return nil
+}
+
+// statusKind classifies HTTP response status, returns kind sentinel or nil if unclassified
+func statusKind(code int) error {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrPermissionDenied
+	case code == http.StatusNotFound:
+		return ErrObjectNotFound
+	case code == http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case code == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case code == http.StatusRequestTimeout || code >= http.StatusInternalServerError:
+		return ErrTransient
+	}
+	return nil
+}
+
+// responseError is an error response of a REST storage API
+type responseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *responseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// isPreconditionFailed checks if error is a failed generation/metageneration precondition
+func isPreconditionFailed(err error) bool {
+	return hasStatus(err, http.StatusPreconditionFailed)
+}
+
+// isRangeNotSatisfiable checks if error is a range request beyond object size
+func isRangeNotSatisfiable(err error) bool {
+	return hasStatus(err, http.StatusRequestedRangeNotSatisfiable)
+}
+
+// hasStatus checks if error is an API error response with given status
+func hasStatus(err error, code int) bool {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code == code
+	}
+	var rErr *responseError
+	return errors.As(err, &rErr) && rErr.StatusCode == code
+}
@@ -0,0 +1,61 @@
+package cloudstorage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func TestStorageErrorKinds(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		err  error
+		kind error
+	}{
+		"object not exist":    {storage.ErrObjectNotExist, ErrObjectNotFound},
+		"bucket not exist":    {storage.ErrBucketNotExist, ErrBucketNotFound},
+		"forbidden":           {&googleapi.Error{Code: http.StatusForbidden}, ErrPermissionDenied},
+		"precondition failed": {&googleapi.Error{Code: http.StatusPreconditionFailed}, ErrPreconditionFailed},
+		"too many requests":   {&googleapi.Error{Code: http.StatusTooManyRequests}, ErrRateLimited},
+		"service unavailable": {&googleapi.Error{Code: http.StatusServiceUnavailable}, ErrTransient},
+		"deadline exceeded":   {context.DeadlineExceeded, ErrTransient},
+		"canceled":            {context.Canceled, ErrCanceled},
+		"canceled request":    {&url.Error{Op: "Get", URL: "http://storage", Err: context.Canceled}, ErrCanceled},
+		"file not exist":      {fs.ErrNotExist, ErrObjectNotFound},
+		"no such bucket":      {&responseError{StatusCode: http.StatusNotFound, Code: "NoSuchBucket"}, ErrBucketNotFound},
+		"no such key":         {&responseError{StatusCode: http.StatusNotFound, Code: "NoSuchKey"}, ErrObjectNotFound},
+		"slow down":           {&responseError{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}, ErrTransient},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			err := wrapStorageError(tc.err, "error reading cloud file %s", "test.json")
+			require.ErrorIs(t, err, tc.kind)
+			require.ErrorIs(t, err, tc.err)
+
+			var sErr *StorageError
+			require.Equal(t, true, errors.As(err, &sErr))
+			require.Equal(t, tc.kind, sErr.Kind)
+		})
+	}
+}
+
+func TestStaleErrorKinds(t *testing.T) {
+	cause := &googleapi.Error{Code: http.StatusPreconditionFailed}
+	err := kindError(ErrStaleUpload, cause)
+	require.ErrorIs(t, err, ErrStaleUpload)
+	require.ErrorIs(t, err, ErrStale)
+	require.ErrorIs(t, err, ErrPreconditionFailed)
+	require.Equal(t, false, errors.Is(err, ErrStaleDownload))
+
+	var gErr *googleapi.Error
+	require.Equal(t, true, errors.As(err, &gErr))
+
+	// nested storage errors keep inner kind
+	err = wrapStorageError(kindError(ErrStaleDownload, nil), "error reading cloud file %s", "test.json")
+	require.ErrorIs(t, err, ErrStale)
+}
@@ -0,0 +1,85 @@
+package cloudstorage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// escapePath escapes object path, keeping path separators
+func escapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return uriEscape(p, false)
+}
+
+// uriEscape URI encodes all but unreserved characters, slash is encoded when escaping query params
+func uriEscape(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexChars[c>>4])
+			b.WriteByte(hexChars[c&15])
+		}
+	}
+	return b.String()
+}
+
+// etagGeneration derives object generation from entity tag
+func etagGeneration(etag string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Trim(etag, `"`)))
+	gen := int64(h.Sum64() >> 1)
+	if gen == 0 {
+		gen = 1
+	}
+	return gen
+}
+
+// writeConditionHeaders takes request & current object info, nil if object doesn't exist,
+// returns stale upload error if request conditions don't hold, or headers guarding the write against concurrent updates
+func writeConditionHeaders(cfr CloudFileRequest, current *ObjectInfo) (http.Header, error) {
+	if err := checkUploadConditions(cfr, current); err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if !cfr.isConditional() {
+		return header, nil
+	}
+	// replace only the object conditions were checked against
+	if current == nil {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", current.ETag)
+	}
+	return header, nil
+}
+
+// isWriteConflict checks if error is a failed or conflicting conditional write
+func isWriteConflict(err error) bool {
+	return isPreconditionFailed(err) || hasStatus(err, http.StatusConflict)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
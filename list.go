@@ -0,0 +1,338 @@
+package cloudstorage
+
+import (
+	"context"
+	"encoding/base64"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// ObjectList holds listed objects & directory prefixes,
+// for paged listing, next page token is empty after last page
+type ObjectList struct {
+	Objects       []ObjectInfo
+	Prefixes      []string
+	NextPageToken string
+}
+
+// ListEntry is a streamed list entry, either an object, a directory prefix or a listing error
+type ListEntry struct {
+	Object *ObjectInfo
+	Prefix string
+	Err    error
+}
+
+// WithDelimiter lists objects up to given delimiter, names sharing
+// a prefix up to the delimiter are returned as directory prefixes
+func WithDelimiter(delimiter string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.delimiter = delimiter
+	}
+}
+
+// WithGlob lists only objects with names matching given glob pattern, see path.Match.
+// Pattern matches full object name, including request path, e.g. data/*.json for path data,
+// & * doesn't match across /
+func WithGlob(glob string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.glob = glob
+	}
+}
+
+// WithStartOffset lists only objects with names lexicographically equal to or after given offset
+func WithStartOffset(offset string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.startOffset = offset
+	}
+}
+
+// WithEndOffset lists only objects with names lexicographically before given offset
+func WithEndOffset(offset string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.endOffset = offset
+	}
+}
+
+// listPrefix returns request path as an object name prefix
+func (cfr CloudFileRequest) listPrefix() string {
+	if cfr.path == "" || strings.HasSuffix(cfr.path, "/") {
+		return cfr.path
+	}
+	return cfr.path + "/"
+}
+
+// listQuery returns storage query for request list attributes
+func (cfr CloudFileRequest) listQuery() *storage.Query {
+	return &storage.Query{
+		Prefix:      cfr.listPrefix(),
+		Delimiter:   cfr.delimiter,
+		StartOffset: cfr.startOffset,
+		EndOffset:   cfr.endOffset,
+	}
+}
+
+// validateList checks request list attributes
+func (cfr CloudFileRequest) validateList() error {
+	if cfr.bucket == "" {
+		return ErrBucketNameMissing
+	}
+	if cfr.glob != "" {
+		if _, err := path.Match(cfr.glob, ""); err != nil {
+			return ErrInvalidGlob
+		}
+	}
+	return nil
+}
+
+// matchGlob checks if object name matches request glob pattern
+func (cfr CloudFileRequest) matchGlob(name string) bool {
+	if cfr.glob == "" {
+		return true
+	}
+	ok, _ := path.Match(cfr.glob, name)
+	return ok
+}
+
+func (cs *cloudStorageClient) ListObjects(ctx context.Context, req CloudFileRequest) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+
+	bucket := cs.client.Bucket(req.bucket)
+	it := bucket.Objects(ctx, req.listQuery())
+	list := ObjectList{
+		Objects:  []ObjectInfo{},
+		Prefixes: []string{},
+	}
+	for {
+		objAttrs, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			} else {
+				cs.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+				return list, wrapStorageError(err, ERROR_LISTING_OBJECTS)
+			}
+		}
+		// with delimiter, directory entries only carry prefix
+		if objAttrs.Prefix != "" {
+			list.Prefixes = append(list.Prefixes, objAttrs.Prefix)
+			continue
+		}
+		if !req.matchGlob(objAttrs.Name) {
+			continue
+		}
+		list.Objects = append(list.Objects, newObjectInfo(objAttrs))
+	}
+	return list, nil
+}
+
+// ListObjectsPage takes page size & page token, empty for first page, returns one page of listing,
+// next page token can be persisted to resume listing later
+func (cs *cloudStorageClient) ListObjectsPage(ctx context.Context, req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	if pageSize <= 0 {
+		return ObjectList{}, ErrInvalidPageSize
+	}
+
+	ctx, cancel := req.withTimeout(ctx, cs.config.MetadataTimeout)
+	defer cancel()
+
+	bucket := cs.client.Bucket(req.bucket).Retryer(storage.WithPolicy(storage.RetryNever))
+	attrs := []*storage.ObjectAttrs{}
+	var nextToken string
+	err := cs.retry.retry(ctx, cs.logger, "list", true, func(attempt int) error {
+		it := bucket.Objects(ctx, req.listQuery())
+		pager := iterator.NewPager(it, pageSize, pageToken)
+
+		var err error
+		attrs = attrs[:0]
+		nextToken, err = pager.NextPage(&attrs)
+		return err
+	})
+	if err != nil {
+		cs.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()), zap.String("pageToken", pageToken))
+		return ObjectList{}, wrapStorageError(err, ERROR_LISTING_OBJECTS)
+	}
+
+	// glob filter applies after paging, a page may hold fewer than page size objects
+	list := ObjectList{
+		Objects:       []ObjectInfo{},
+		Prefixes:      []string{},
+		NextPageToken: nextToken,
+	}
+	for _, objAttrs := range attrs {
+		if objAttrs.Prefix != "" {
+			list.Prefixes = append(list.Prefixes, objAttrs.Prefix)
+			continue
+		}
+		if !req.matchGlob(objAttrs.Name) {
+			continue
+		}
+		list.Objects = append(list.Objects, newObjectInfo(objAttrs))
+	}
+	return list, nil
+}
+
+// StreamObjects streams list entries as they arrive, channel is closed when listing ends,
+// on listing error, after sending error entry, or on context cancellation
+func (cs *cloudStorageClient) StreamObjects(ctx context.Context, req CloudFileRequest) <-chan ListEntry {
+	entryStream := make(chan ListEntry)
+
+	go func() {
+		defer close(entryStream)
+
+		if err := req.validateList(); err != nil {
+			sendListEntry(ctx, entryStream, ListEntry{Err: err})
+			return
+		}
+
+		bucket := cs.client.Bucket(req.bucket)
+		it := bucket.Objects(ctx, req.listQuery())
+		for {
+			objAttrs, err := it.Next()
+			if err != nil {
+				if err == iterator.Done {
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				cs.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+				sendListEntry(ctx, entryStream, ListEntry{Err: wrapStorageError(err, ERROR_LISTING_OBJECTS)})
+				return
+			}
+
+			var entry ListEntry
+			if objAttrs.Prefix != "" {
+				entry.Prefix = objAttrs.Prefix
+			} else {
+				if !req.matchGlob(objAttrs.Name) {
+					continue
+				}
+				info := newObjectInfo(objAttrs)
+				entry.Object = &info
+			}
+			if !sendListEntry(ctx, entryStream, entry) {
+				return
+			}
+		}
+	}()
+
+	return entryStream
+}
+
+// sendListEntry sends entry to stream, returns false if context is done first
+func sendListEntry(ctx context.Context, entryStream chan<- ListEntry, entry ListEntry) bool {
+	select {
+	case entryStream <- entry:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// listEntry is a listed object or directory prefix
+type listEntry struct {
+	name   string
+	info   *ObjectInfo
+	prefix bool
+}
+
+// listObjectInfos takes name sorted object infos, returns list for request,
+// paged when page size is positive, starting after entry encoded in page token
+func listObjectInfos(infos []ObjectInfo, req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	after := ""
+	if pageToken != "" {
+		name, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return ObjectList{}, ErrInvalidPageToken
+		}
+		after = string(name)
+	}
+
+	prefix := req.listPrefix()
+	entries := []listEntry{}
+	seen := map[string]bool{}
+	for i := range infos {
+		name := infos[i].Name
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if req.startOffset != "" && name < req.startOffset {
+			continue
+		}
+		if req.endOffset != "" && name >= req.endOffset {
+			continue
+		}
+		// with delimiter, names sharing prefix up to delimiter collapse into one directory entry
+		if req.delimiter != "" {
+			if idx := strings.Index(name[len(prefix):], req.delimiter); idx >= 0 {
+				dir := name[:len(prefix)+idx+len(req.delimiter)]
+				if !seen[dir] {
+					seen[dir] = true
+					entries = append(entries, listEntry{name: dir, prefix: true})
+				}
+				continue
+			}
+		}
+		entries = append(entries, listEntry{name: name, info: &infos[i]})
+	}
+
+	list := ObjectList{
+		Objects:  []ObjectInfo{},
+		Prefixes: []string{},
+	}
+	cnt := 0
+	for _, entry := range entries {
+		if after != "" && entry.name <= after {
+			continue
+		}
+		if pageSize > 0 && cnt == pageSize {
+			list.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(after))
+			break
+		}
+		cnt++
+		after = entry.name
+
+		if entry.prefix {
+			list.Prefixes = append(list.Prefixes, entry.name)
+			continue
+		}
+		// glob filter applies after paging, same as cloud listing
+		if !req.matchGlob(entry.name) {
+			continue
+		}
+		list.Objects = append(list.Objects, *entry.info)
+	}
+	return list, nil
+}
+
+// streamObjectList streams entries of given list, or given listing error, channel is closed when done or on context cancellation
+func streamObjectList(ctx context.Context, list ObjectList, err error) <-chan ListEntry {
+	entryStream := make(chan ListEntry)
+	go func() {
+		defer close(entryStream)
+		if err != nil {
+			sendListEntry(ctx, entryStream, ListEntry{Err: err})
+			return
+		}
+		for _, prefix := range list.Prefixes {
+			if !sendListEntry(ctx, entryStream, ListEntry{Prefix: prefix}) {
+				return
+			}
+		}
+		for i := range list.Objects {
+			if !sendListEntry(ctx, entryStream, ListEntry{Object: &list.Objects[i]}) {
+				return
+			}
+		}
+	}()
+	return entryStream
+}
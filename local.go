@@ -0,0 +1,835 @@
+package cloudstorage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comfforts/errors"
+	"github.com/comfforts/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	FILE_SCHEME = "file"
+	// LOCAL_STORAGE_DIR holds sidecar metadata & in progress uploads under local storage root
+	LOCAL_STORAGE_DIR = ".cloudstorage"
+	LOCAL_META_EXT    = ".json"
+)
+
+func init() {
+	RegisterBackend(FILE_SCHEME, func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		// file:///abs/path, file://rel/path or file:rel/path
+		root := storageURL.Path
+		if storageURL.Opaque != "" {
+			root = storageURL.Opaque
+		} else if storageURL.Host != "" {
+			root = storageURL.Host + storageURL.Path
+		}
+		if root == "" {
+			logger.Error(ERROR_INVALID_STORAGE_URL, zap.String("storageURL", cfg.StorageURL))
+			return nil, ErrInvalidStorageURL
+		}
+		return NewLocalStorageClient(root, logger)
+	})
+}
+
+// localObjectMeta is sidecar metadata stored alongside local object data
+type localObjectMeta struct {
+	Name            string            `json:"name"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	StorageClass    string            `json:"storage_class,omitempty"`
+	Generation      int64             `json:"generation"`
+	Metageneration  int64             `json:"metageneration"`
+	CRC32C          uint32            `json:"crc32c"`
+	MD5             []byte            `json:"md5,omitempty"`
+	Created         time.Time         `json:"created"`
+	Updated         time.Time         `json:"updated"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// localStorageClient is a cloud storage rooted at a local directory,
+// buckets are root subdirectories, objects are files, object attributes are kept in sidecar files.
+// Writes are atomic, data & metadata are written to temp files & renamed in place,
+// conditional writes are serialized within the client, not across processes
+type localStorageClient struct {
+	root    string
+	mu      sync.RWMutex
+	lastGen int64
+	logger  logger.AppLogger
+}
+
+// NewLocalStorageClient takes storage root directory & logger, returns local storage client
+func NewLocalStorageClient(root string, logger logger.AppLogger) (*localStorageClient, error) {
+	if logger == nil || root == "" {
+		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err), zap.String("root", root))
+		return nil, wrapStorageError(err, ERROR_CREATING_STORAGE_CLIENT)
+	}
+	if err := os.MkdirAll(filepath.Join(root, LOCAL_STORAGE_DIR, "tmp"), os.ModePerm); err != nil {
+		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err), zap.String("root", root))
+		return nil, wrapStorageError(err, ERROR_CREATING_STORAGE_CLIENT)
+	}
+	return &localStorageClient{
+		root:   root,
+		logger: logger,
+	}, nil
+}
+
+// validateBucket checks bucket name maps to a storage root subdirectory
+func validateBucket(bucket string) error {
+	if bucket == "" {
+		return ErrBucketNameMissing
+	}
+	if strings.HasPrefix(bucket, ".") || strings.ContainsAny(bucket, `/\`) {
+		return ErrInvalidBucketName
+	}
+	return nil
+}
+
+// objectPaths takes bucket & object name, returns object data & sidecar metadata file paths
+func (ls *localStorageClient) objectPaths(bucket, name string) (string, string, error) {
+	if err := validateBucket(bucket); err != nil {
+		return "", "", err
+	}
+	// keep objects inside bucket directory, names must map to the stored name unchanged
+	// so object info & sidecar metadata match the object path
+	rel := filepath.ToSlash(name)
+	if rel == "" || strings.HasPrefix(rel, "/") || path.Clean(rel) != rel {
+		return "", "", ErrInvalidObjectName
+	}
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == ".." {
+			return "", "", ErrInvalidObjectName
+		}
+	}
+	rel = filepath.FromSlash(rel)
+	return filepath.Join(ls.root, bucket, rel),
+		filepath.Join(ls.root, LOCAL_STORAGE_DIR, "meta", bucket, rel+LOCAL_META_EXT),
+		nil
+}
+
+// nextGeneration returns a new object generation, newer than given current generation,
+// caller must hold write lock
+func (ls *localStorageClient) nextGeneration(current int64) int64 {
+	gen := time.Now().UnixMicro()
+	if gen <= ls.lastGen {
+		gen = ls.lastGen + 1
+	}
+	if gen <= current {
+		gen = current + 1
+	}
+	ls.lastGen = gen
+	return gen
+}
+
+// objectInfo takes bucket, object name & file paths, returns object info or object not found error,
+// files without sidecar metadata get attributes derived from the file
+func (ls *localStorageClient) objectInfo(bucket, name, dataPath, metaPath string) (*ObjectInfo, error) {
+	fi, err := os.Stat(dataPath)
+	if err != nil {
+		if isKind(err, fs.ErrNotExist) {
+			return nil, kindError(ErrObjectNotFound, err)
+		}
+		return nil, wrapStorageError(err, "local file inaccessible %s", name)
+	}
+	if fi.IsDir() {
+		return nil, kindError(ErrObjectNotFound, nil)
+	}
+
+	meta, err := readLocalMeta(metaPath)
+	if err != nil {
+		return nil, wrapStorageError(err, "error reading local file metadata %s", name)
+	}
+	if meta == nil {
+		return &ObjectInfo{
+			Bucket:         bucket,
+			Name:           name,
+			Size:           fi.Size(),
+			ContentType:    mime.TypeByExtension(filepath.Ext(name)),
+			Generation:     fi.ModTime().UnixMicro(),
+			Metageneration: 1,
+			StorageClass:   DEFAULT_STORAGE_CLASS,
+			Created:        fi.ModTime(),
+			Updated:        fi.ModTime(),
+		}, nil
+	}
+	info := localInfo(bucket, *meta, fi.Size())
+	return &info, nil
+}
+
+// currentInfo returns object info, nil if object doesn't exist
+func (ls *localStorageClient) currentInfo(bucket, name, dataPath, metaPath string) (*ObjectInfo, error) {
+	info, err := ls.objectInfo(bucket, name, dataPath, metaPath)
+	if err != nil {
+		if isKind(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// readLocalMeta reads sidecar metadata, nil if there is none
+func readLocalMeta(metaPath string) (*localObjectMeta, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		if isKind(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	meta := localObjectMeta{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// tempFile creates a temp file in storage temp directory
+func (ls *localStorageClient) tempFile() (*os.File, error) {
+	return os.CreateTemp(filepath.Join(ls.root, LOCAL_STORAGE_DIR, "tmp"), "upload-*")
+}
+
+// commitObject moves data temp file, when given, & metadata in place, metadata last,
+// caller must hold write lock
+func (ls *localStorageClient) commitObject(tmpPath, dataPath, metaPath string, meta localObjectMeta) error {
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metaTmp, err := ls.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(metaTmp.Name())
+	if _, err := metaTmp.Write(metaData); err != nil {
+		metaTmp.Close()
+		return err
+	}
+	if err := metaTmp.Close(); err != nil {
+		return err
+	}
+
+	for _, p := range []string{dataPath, metaPath} {
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if tmpPath != "" {
+		if err := os.Rename(tmpPath, dataPath); err != nil {
+			return err
+		}
+	}
+	return os.Rename(metaTmp.Name(), metaPath)
+}
+
+// removeObject removes object data & metadata files, along with emptied directories,
+// caller must hold write lock
+func (ls *localStorageClient) removeObject(bucket, dataPath, metaPath string) error {
+	if err := os.Remove(dataPath); err != nil {
+		return err
+	}
+	if err := os.Remove(metaPath); err != nil && !isKind(err, fs.ErrNotExist) {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(dataPath), filepath.Join(ls.root, bucket))
+	removeEmptyDirs(filepath.Dir(metaPath), filepath.Join(ls.root, LOCAL_STORAGE_DIR, "meta", bucket))
+	return nil
+}
+
+// removeEmptyDirs removes given directory & its parents while empty, up to stop directory
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// newLocalMeta takes object name, checksums, current attributes & request overrides, returns new object generation metadata,
+// caller must hold write lock
+func (ls *localStorageClient) newLocalMeta(name string, crc uint32, md5Sum []byte, base, current *ObjectInfo, cfr CloudFileRequest) localObjectMeta {
+	now := time.Now()
+	var currentGen int64
+	if current != nil {
+		currentGen = current.Generation
+	}
+	meta := localObjectMeta{
+		Name:           name,
+		StorageClass:   DEFAULT_STORAGE_CLASS,
+		Generation:     ls.nextGeneration(currentGen),
+		Metageneration: 1,
+		CRC32C:         crc,
+		MD5:            md5Sum,
+		Created:        now,
+		Updated:        now,
+	}
+	if base != nil {
+		meta.ContentType = base.ContentType
+		meta.ContentEncoding = base.ContentEncoding
+		meta.StorageClass = base.StorageClass
+		meta.Metadata = copyMetadata(base.Metadata)
+	}
+	if cfr.contentType != "" {
+		meta.ContentType = cfr.contentType
+	}
+	if cfr.storageClass != "" {
+		meta.StorageClass = cfr.storageClass
+	}
+	if cfr.metadata != nil {
+		meta.Metadata = copyMetadata(cfr.metadata)
+	}
+	return meta
+}
+
+func (ls *localStorageClient) UploadFile(ctx context.Context, file io.Reader, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	fPath := cfr.objectName()
+	dataPath, metaPath, err := ls.objectPaths(cfr.bucket, fPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// stream data to temp file, computing checksums
+	tmp, err := ls.tempFile()
+	if err != nil {
+		ls.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	defer os.Remove(tmp.Name())
+
+	crcHash, md5Hash := crc32.New(crc32cTable), md5.New()
+	sniff := &sniffWriter{}
+	nBytes, err := io.Copy(io.MultiWriter(tmp, crcHash, md5Hash, sniff), file)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		ls.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, wrapStorageError(err, ERROR_STORAGE_CANCELED)
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	current, err := ls.currentInfo(cfr.bucket, fPath, dataPath, metaPath)
+	if err != nil {
+		ls.logger.Error("local file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return 0, err
+	}
+	if err := checkUploadConditions(cfr, current); err != nil {
+		ls.logger.Error(ERROR_STALE_UPLOAD, zap.String("filepath", fPath), zap.Int64("modTime", cfr.modTime), zap.Int64("generation", cfr.generation))
+		return 0, err
+	}
+
+	meta := ls.newLocalMeta(fPath, crcHash.Sum32(), md5Hash.Sum(nil), nil, current, cfr)
+	// sniff content type like cloud uploads do
+	if meta.ContentType == "" {
+		meta.ContentType = http.DetectContentType(sniff.data)
+	}
+	if err := ls.commitObject(tmp.Name(), dataPath, metaPath, meta); err != nil {
+		ls.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	ls.logger.Debug("local file created/updated", zap.String("filepath", fPath), zap.Int64("generation", meta.Generation))
+	return nBytes, nil
+}
+
+// sniffWriter keeps data needed for content type detection
+type sniffWriter struct {
+	data []byte
+}
+
+func (sw *sniffWriter) Write(p []byte) (int, error) {
+	if rem := 512 - len(sw.data); rem > 0 {
+		if len(p) < rem {
+			rem = len(p)
+		}
+		sw.data = append(sw.data, p[:rem]...)
+	}
+	return len(p), nil
+}
+
+// openObject opens object data file, returns object not found or,
+// when pinned to a generation, stale download error.
+// Open file keeps reading opened generation even if object is replaced
+func (ls *localStorageClient) openObject(bucket, name string, gen int64) (*os.File, *ObjectInfo, error) {
+	dataPath, metaPath, err := ls.objectPaths(bucket, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	info, err := ls.objectInfo(bucket, name, dataPath, metaPath)
+	if err != nil {
+		if gen > 0 && isKind(err, ErrObjectNotFound) {
+			return nil, nil, kindError(ErrStaleDownload, err)
+		}
+		return nil, nil, err
+	}
+	if gen > 0 && info.Generation != gen {
+		return nil, nil, kindError(ErrStaleDownload, nil)
+	}
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return nil, nil, wrapStorageError(err, "local file inaccessible %s", name)
+	}
+	return f, info, nil
+}
+
+func (ls *localStorageClient) DownloadFile(ctx context.Context, file io.Writer, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	fPath := cfr.objectName()
+
+	f, _, err := ls.openObject(cfr.bucket, fPath, cfr.generation)
+	if err != nil {
+		ls.logger.Error("local file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(file, f)
+	if err != nil {
+		ls.logger.Error("error copying local file", zap.Error(err), zap.String("filepath", fPath))
+		return n, wrapStorageError(err, "error copying cloud file %s", fPath)
+	}
+	return n, nil
+}
+
+// rangeReader returns range reader func for local object, pinned to given generation when set
+func (ls *localStorageClient) rangeReader(bucket, name string, gen int64) rangeReaderFunc {
+	return func(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapStorageError(err, ERROR_STORAGE_CANCELED)
+		}
+		f, info, err := ls.openObject(bucket, name, gen)
+		if err != nil {
+			return nil, err
+		}
+		if off >= info.Size {
+			f.Close()
+			return nil, io.EOF
+		}
+		n := info.Size - off
+		if length >= 0 && length < n {
+			n = length
+		}
+		return &localRangeReader{
+			Reader: io.NewSectionReader(f, off, n),
+			file:   f,
+		}, nil
+	}
+}
+
+type localRangeReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (lr *localRangeReader) Close() error {
+	return lr.file.Close()
+}
+
+func (ls *localStorageClient) ReadAt(ctx context.Context, cfr CloudFileRequest, p []byte, off int64) (int, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	fPath := cfr.objectName()
+	cfr, err := cfr.pinReads(ctx, ls.StatObject)
+	if err != nil {
+		return 0, err
+	}
+
+	co := newCloudObject(ctx, fPath, -1, cfr.generation, ls.rangeReader(cfr.bucket, fPath, cfr.generation))
+	return co.ReadAt(p, off)
+}
+
+func (ls *localStorageClient) StatObject(ctx context.Context, cfr CloudFileRequest) (ObjectInfo, error) {
+	if cfr.bucket == "" {
+		return ObjectInfo{}, ErrBucketNameMissing
+	}
+	if cfr.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+	fPath := cfr.objectName()
+	dataPath, metaPath, err := ls.objectPaths(cfr.bucket, fPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	info, err := ls.objectInfo(cfr.bucket, fPath, dataPath, metaPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return *info, nil
+}
+
+func (ls *localStorageClient) OpenObject(ctx context.Context, cfr CloudFileRequest) (CloudObject, error) {
+	if cfr.file == "" {
+		return nil, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return nil, ErrBucketNameMissing
+	}
+	fPath := cfr.objectName()
+
+	f, info, err := ls.openObject(cfr.bucket, fPath, cfr.generation)
+	if err != nil {
+		ls.logger.Error("local file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return nil, err
+	}
+	f.Close()
+
+	// pin all reads through the handle to opened generation
+	return newCloudObject(ctx, fPath, info.Size, info.Generation, ls.rangeReader(cfr.bucket, fPath, info.Generation)), nil
+}
+
+// bucketInfos returns name sorted infos of bucket objects under given prefix
+func (ls *localStorageClient) bucketInfos(bucket, prefix string) ([]ObjectInfo, error) {
+	if err := validateBucket(bucket); err != nil {
+		return nil, err
+	}
+
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	// walk only directory of prefix
+	bucketDir := filepath.Join(ls.root, bucket)
+	walkDir := bucketDir
+	if dir := path.Clean("/" + prefix[:strings.LastIndex(prefix, "/")+1])[1:]; dir != "" {
+		walkDir = filepath.Join(bucketDir, filepath.FromSlash(dir))
+	}
+
+	infos := []ObjectInfo{}
+	err := filepath.WalkDir(walkDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if isKind(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		dataPath, metaPath, err := ls.objectPaths(bucket, name)
+		if err != nil {
+			return err
+		}
+		info, err := ls.objectInfo(bucket, name, dataPath, metaPath)
+		if err != nil {
+			// removed while listing
+			if isKind(err, ErrObjectNotFound) {
+				return nil
+			}
+			return err
+		}
+		infos = append(infos, *info)
+		return nil
+	})
+	if err != nil {
+		return nil, wrapStorageError(err, ERROR_LISTING_OBJECTS)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+func (ls *localStorageClient) ListObjects(ctx context.Context, req CloudFileRequest) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	return ls.listObjects(req, 0, "")
+}
+
+func (ls *localStorageClient) ListObjectsPage(ctx context.Context, req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	if pageSize <= 0 {
+		return ObjectList{}, ErrInvalidPageSize
+	}
+	return ls.listObjects(req, pageSize, pageToken)
+}
+
+// listObjects lists request objects, all of them when page size is 0
+func (ls *localStorageClient) listObjects(req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	infos, err := ls.bucketInfos(req.bucket, req.listPrefix())
+	if err != nil {
+		ls.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+		return ObjectList{}, err
+	}
+	return listObjectInfos(infos, req, pageSize, pageToken)
+}
+
+func (ls *localStorageClient) StreamObjects(ctx context.Context, req CloudFileRequest) <-chan ListEntry {
+	list, err := ls.ListObjects(ctx, req)
+	return streamObjectList(ctx, list, err)
+}
+
+func (ls *localStorageClient) CopyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	return ls.copyObject(src, dst, false)
+}
+
+func (ls *localStorageClient) MoveObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	return ls.copyObject(src, dst, true)
+}
+
+// copyObject copies source to destination, moving source data in place when moving
+func (ls *localStorageClient) copyObject(src, dst CloudFileRequest, move bool) (ObjectInfo, error) {
+	if src.file == "" || dst.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+	srcName, dstName := src.objectName(), dst.objectName()
+	srcData, srcMeta, err := ls.objectPaths(src.bucket, srcName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	dstData, dstMeta, err := ls.objectPaths(dst.bucket, dstName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	srcInfo, err := ls.objectInfo(src.bucket, srcName, srcData, srcMeta)
+	if err != nil {
+		ls.logger.Error("local file inaccessible", zap.Error(err), zap.String("filepath", srcName))
+		return ObjectInfo{}, err
+	}
+	if src.generation > 0 && srcInfo.Generation != src.generation {
+		ls.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("src", srcName), zap.Int64("generation", src.generation))
+		return ObjectInfo{}, kindError(ErrStaleDownload, nil)
+	}
+
+	// destination preconditions, modification time applies to uploads only
+	current, err := ls.currentInfo(dst.bucket, dstName, dstData, dstMeta)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	dst.modTime = 0
+	if err := checkUploadConditions(dst, current); err != nil {
+		ls.logger.Error(ERROR_STALE_UPLOAD, zap.String("src", srcName), zap.String("dst", dstName))
+		return ObjectInfo{}, err
+	}
+
+	errMsg := ERROR_COPYING_OBJECT
+	if move {
+		errMsg = ERROR_MOVING_OBJECT
+	}
+	if srcData == dstData {
+		// copy onto itself rewrites attributes only
+		meta := ls.newLocalMeta(dstName, srcInfo.CRC32C, srcInfo.MD5, srcInfo, current, dst)
+		if err := ls.commitObject("", dstData, dstMeta, meta); err != nil {
+			ls.logger.Error(errMsg, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+			return ObjectInfo{}, wrapStorageError(err, errMsg)
+		}
+		return localInfo(dst.bucket, meta, srcInfo.Size), nil
+	}
+
+	tmpPath := ""
+	if move {
+		// moved data is renamed in place, source metadata is removed after
+		tmpPath = srcData
+	} else {
+		tmpPath, err = ls.copyToTemp(srcData)
+		if err != nil {
+			ls.logger.Error(errMsg, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+			return ObjectInfo{}, wrapStorageError(err, errMsg)
+		}
+		defer os.Remove(tmpPath)
+	}
+
+	meta := ls.newLocalMeta(dstName, srcInfo.CRC32C, srcInfo.MD5, srcInfo, current, dst)
+	if err := ls.commitObject(tmpPath, dstData, dstMeta, meta); err != nil {
+		ls.logger.Error(errMsg, zap.Error(err), zap.String("src", srcName), zap.String("dst", dstName))
+		return ObjectInfo{}, wrapStorageError(err, errMsg)
+	}
+	if move {
+		if err := os.Remove(srcMeta); err != nil && !isKind(err, fs.ErrNotExist) {
+			ls.logger.Error(errMsg, zap.Error(err), zap.String("src", srcName))
+			return ObjectInfo{}, wrapStorageError(err, errMsg)
+		}
+		removeEmptyDirs(filepath.Dir(srcData), filepath.Join(ls.root, src.bucket))
+		removeEmptyDirs(filepath.Dir(srcMeta), filepath.Join(ls.root, LOCAL_STORAGE_DIR, "meta", src.bucket))
+	}
+	ls.logger.Debug("copied local file", zap.String("src", srcName), zap.String("dst", dstName), zap.Bool("move", move))
+	return localInfo(dst.bucket, meta, srcInfo.Size), nil
+}
+
+// copyToTemp copies given file to a temp file, returns temp file path
+func (ls *localStorageClient) copyToTemp(srcPath string) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := ls.tempFile()
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, src)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// localInfo returns object info for given bucket, metadata & size
+func localInfo(bucket string, meta localObjectMeta, size int64) ObjectInfo {
+	return ObjectInfo{
+		Bucket:          bucket,
+		Name:            meta.Name,
+		Size:            size,
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		Generation:      meta.Generation,
+		Metageneration:  meta.Metageneration,
+		StorageClass:    meta.StorageClass,
+		CRC32C:          meta.CRC32C,
+		MD5:             meta.MD5,
+		Created:         meta.Created,
+		Updated:         meta.Updated,
+		Metadata:        meta.Metadata,
+	}
+}
+
+func (ls *localStorageClient) DeleteObject(ctx context.Context, req CloudFileRequest) error {
+	if req.bucket == "" {
+		return ErrBucketNameMissing
+	}
+	if req.path == "" {
+		return ErrFilePathMissing
+	}
+	if req.file == "" {
+		return ErrFileNameMissing
+	}
+	objName := req.objectName()
+	dataPath, metaPath, err := ls.objectPaths(req.bucket, objName)
+	if err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if err := ls.removeObject(req.bucket, dataPath, metaPath); err != nil {
+		ls.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", objName))
+		return wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	return nil
+}
+
+func (ls *localStorageClient) DeleteObjects(ctx context.Context, req CloudFileRequest) (DeleteSummary, error) {
+	if err := req.validateList(); err != nil {
+		return DeleteSummary{}, err
+	}
+	// guard against wiping entire bucket
+	if req.path == "" && !req.deleteAll {
+		return DeleteSummary{}, ErrDeletePrefixMissing
+	}
+
+	list, err := ls.ListObjects(ctx, req)
+	if err != nil {
+		return DeleteSummary{}, err
+	}
+
+	summary := DeleteSummary{
+		DryRun:  req.dryRun,
+		Deleted: []string{},
+		Failed:  []string{},
+		Results: []DeleteResult{},
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, listed := range list.Objects {
+		result := DeleteResult{
+			Key:    listed.Name,
+			Status: DeleteStatusDeleted,
+		}
+		// delete only listed generation, skip objects replaced since listing
+		dataPath, metaPath, err := ls.objectPaths(req.bucket, listed.Name)
+		var info *ObjectInfo
+		if err == nil {
+			info, err = ls.currentInfo(req.bucket, listed.Name, dataPath, metaPath)
+		}
+		switch {
+		case err != nil:
+			result.Status = DeleteStatusFailed
+			result.Err = err
+		case info == nil:
+			result.Status = DeleteStatusNotFound
+			result.Err = kindError(ErrObjectNotFound, nil)
+		case info.Generation != listed.Generation:
+			result.Status = DeleteStatusPreconditionFailed
+			result.Err = kindError(ErrPreconditionFailed, nil)
+		case !req.dryRun:
+			if err := ls.removeObject(req.bucket, dataPath, metaPath); err != nil {
+				ls.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", listed.Name))
+				result.Status = DeleteStatusFailed
+				result.Err = wrapStorageError(err, ERROR_DELETING_OBJECT)
+			}
+		}
+
+		summary.add(result)
+	}
+	ls.logger.Info("deleted objects", zap.String("prefix", req.listPrefix()), zap.Bool("dryRun", req.dryRun), zap.Int("deleted", len(summary.Deleted)), zap.Int("failed", len(summary.Failed)))
+	if len(summary.Failed) > 0 {
+		return summary, ErrDeleteIncomplete
+	}
+	return summary, nil
+}
+
+func (ls *localStorageClient) Close() error {
+	return nil
+}
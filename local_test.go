@@ -0,0 +1,110 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalFileStorage(t *testing.T) {
+	runStorageScenarios(t, func(t *testing.T, testCfg *testConfig) (CloudStorage, func()) {
+		// scenario files & object names share dir, object names must be relative
+		root := chdirTemp(t)
+		testCfg.dir = "data"
+		client, err := NewLocalStorageClient(filepath.Join(root, "storage"), logger.NewTestAppLogger(root))
+		require.NoError(t, err)
+		return client, func() {
+			err := client.Close()
+			require.NoError(t, err)
+		}
+	})
+}
+
+// chdirTemp changes working directory to a test temp directory, restored on cleanup
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() {
+		require.NoError(t, os.Chdir(wd))
+	})
+	return dir
+}
+
+func TestLocalStorageLayout(t *testing.T) {
+	root := t.TempDir()
+	client, err := NewCloudStorage(CloudStorageClientConfig{StorageURL: "file://" + root}, logger.NewTestAppLogger(root))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfr, err := NewCloudFileRequest("test-bucket", "a.json", "data", 0, WithMetadata(map[string]string{"owner": "test"}))
+	require.NoError(t, err)
+	n, err := client.UploadFile(ctx, bytes.NewReader([]byte(`{"id":1}`)), cfr)
+	require.NoError(t, err)
+
+	// bucket maps to root subdirectory, object to file
+	data, err := os.ReadFile(filepath.Join(root, "test-bucket", "data", "a.json"))
+	require.NoError(t, err)
+	require.Equal(t, n, int64(len(data)))
+
+	info, err := client.StatObject(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, "data/a.json", info.Name)
+	require.Equal(t, "test", info.Metadata["owner"])
+	require.Equal(t, true, info.Generation > 0)
+
+	// files added outside the client are listed with derived attributes
+	err = os.WriteFile(filepath.Join(root, "test-bucket", "data", "b.csv"), []byte("a,b\n"), 0644)
+	require.NoError(t, err)
+	listCfr, err := NewCloudFileRequest("test-bucket", "", "data", 0)
+	require.NoError(t, err)
+	list, err := client.ListObjects(ctx, listCfr)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list.Objects))
+	require.Equal(t, "data/b.csv", list.Objects[1].Name)
+	require.Equal(t, int64(4), list.Objects[1].Size)
+
+	// names escaping or not mapping to bucket paths are rejected
+	for _, name := range []string{"../../escaped.json", "../escaped.json", "/escaped.json", "a/./b.json", "a//b.json"} {
+		escCfr, err := NewCloudFileRequest("test-bucket", name, "", 0)
+		require.NoError(t, err)
+		_, err = client.UploadFile(ctx, bytes.NewReader(data), escCfr)
+		require.ErrorIs(t, err, ErrInvalidObjectName, name)
+	}
+	escCfr, err := NewCloudFileRequest("test-bucket", "../../escaped.json", "data", 0)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), escCfr)
+	require.ErrorIs(t, err, ErrInvalidObjectName)
+	_, err = os.Stat(filepath.Join(root, "test-bucket", "escaped.json"))
+	require.Equal(t, true, os.IsNotExist(err))
+
+	bktCfr, err := NewCloudFileRequest(".cloudstorage", "a.json", "data", 0)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), bktCfr)
+	require.ErrorIs(t, err, ErrInvalidBucketName)
+
+	missingCfr, err := NewCloudFileRequest("test-bucket", "missing.json", "data", 0)
+	require.NoError(t, err)
+	_, err = client.StatObject(ctx, missingCfr)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+	err = client.DeleteObject(ctx, missingCfr)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+
+	delCfr, err := NewCloudFileRequest("test-bucket", "", "data", 0)
+	require.NoError(t, err)
+	summary, err := client.DeleteObjects(ctx, delCfr)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(summary.Deleted))
+
+	// emptied directories are removed
+	_, err = os.Stat(filepath.Join(root, "test-bucket", "data"))
+	require.Equal(t, true, os.IsNotExist(err))
+}
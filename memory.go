@@ -0,0 +1,464 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/comfforts/errors"
+	"github.com/comfforts/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	MEM_SCHEME            = "mem"
+	DEFAULT_STORAGE_CLASS = "STANDARD"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func init() {
+	RegisterBackend(MEM_SCHEME, func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		return NewMemoryStorageClient(logger)
+	})
+}
+
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+// memoryStorageClient is a concurrency safe in memory cloud storage,
+// buckets are created on first write, stored object data is never mutated
+type memoryStorageClient struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]*memoryObject
+	lastGen int64
+	logger  logger.AppLogger
+}
+
+// NewMemoryStorageClient takes logger, returns in memory cloud storage client
+func NewMemoryStorageClient(logger logger.AppLogger) (*memoryStorageClient, error) {
+	if logger == nil {
+		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+	return &memoryStorageClient{
+		buckets: map[string]map[string]*memoryObject{},
+		logger:  logger,
+	}, nil
+}
+
+// nextGeneration returns a new, increasing, object generation, caller must hold write lock
+func (ms *memoryStorageClient) nextGeneration() int64 {
+	gen := time.Now().UnixMicro()
+	if gen <= ms.lastGen {
+		gen = ms.lastGen + 1
+	}
+	ms.lastGen = gen
+	return gen
+}
+
+// object returns stored object, nil if it doesn't exist, caller must hold lock
+func (ms *memoryStorageClient) object(bucket, name string) *memoryObject {
+	objs, ok := ms.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	return objs[name]
+}
+
+// putObject stores object, creating bucket if needed, caller must hold write lock
+func (ms *memoryStorageClient) putObject(obj *memoryObject) {
+	objs, ok := ms.buckets[obj.info.Bucket]
+	if !ok {
+		objs = map[string]*memoryObject{}
+		ms.buckets[obj.info.Bucket] = objs
+	}
+	objs[obj.info.Name] = obj
+}
+
+// newMemoryObject takes bucket, name, data & request attribute overrides, returns new object generation
+func (ms *memoryStorageClient) newMemoryObject(bucket, name string, data []byte, cfr CloudFileRequest, base *ObjectInfo) *memoryObject {
+	now := time.Now()
+	md5Sum := md5.Sum(data)
+	info := ObjectInfo{
+		Bucket:         bucket,
+		Name:           name,
+		Size:           int64(len(data)),
+		Generation:     ms.nextGeneration(),
+		Metageneration: 1,
+		StorageClass:   DEFAULT_STORAGE_CLASS,
+		CRC32C:         crc32.Checksum(data, crc32cTable),
+		MD5:            md5Sum[:],
+		Created:        now,
+		Updated:        now,
+	}
+	if base != nil {
+		info.ContentType = base.ContentType
+		info.ContentEncoding = base.ContentEncoding
+		info.StorageClass = base.StorageClass
+		info.Metadata = copyMetadata(base.Metadata)
+	}
+	if cfr.contentType != "" {
+		info.ContentType = cfr.contentType
+	}
+	if cfr.storageClass != "" {
+		info.StorageClass = cfr.storageClass
+	}
+	if cfr.metadata != nil {
+		info.Metadata = copyMetadata(cfr.metadata)
+	}
+	// sniff content type like cloud uploads do
+	if info.ContentType == "" {
+		info.ContentType = http.DetectContentType(data)
+	}
+	return &memoryObject{
+		info: info,
+		data: data,
+	}
+}
+
+func (ms *memoryStorageClient) UploadFile(ctx context.Context, file io.Reader, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	fPath := cfr.objectName()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		ms.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, wrapStorageError(err, ERROR_STORAGE_CANCELED)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var current *ObjectInfo
+	if obj := ms.object(cfr.bucket, fPath); obj != nil {
+		current = &obj.info
+	}
+	if err := checkUploadConditions(cfr, current); err != nil {
+		ms.logger.Error(ERROR_STALE_UPLOAD, zap.String("filepath", fPath), zap.Int64("modTime", cfr.modTime), zap.Int64("generation", cfr.generation))
+		return 0, err
+	}
+
+	obj := ms.newMemoryObject(cfr.bucket, fPath, data, cfr, nil)
+	ms.putObject(obj)
+	ms.logger.Debug("memory file created/updated", zap.String("filepath", fPath), zap.Int64("generation", obj.info.Generation))
+	return obj.info.Size, nil
+}
+
+func (ms *memoryStorageClient) DownloadFile(ctx context.Context, file io.Writer, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	fPath := cfr.objectName()
+
+	obj, err := ms.readableObject(cfr.bucket, fPath, cfr.generation)
+	if err != nil {
+		ms.logger.Error("memory file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, wrapStorageError(err, ERROR_STORAGE_CANCELED)
+	}
+
+	n, err := file.Write(obj.data)
+	if err != nil {
+		ms.logger.Error("error copying memory file", zap.Error(err), zap.String("filepath", fPath))
+		return int64(n), wrapStorageError(err, "error copying cloud file %s", fPath)
+	}
+	return int64(n), nil
+}
+
+// readableObject returns stored object, object not found or, when pinned to a generation, stale download error
+func (ms *memoryStorageClient) readableObject(bucket, name string, gen int64) (*memoryObject, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	obj := ms.object(bucket, name)
+	if obj == nil {
+		if gen > 0 {
+			return nil, kindError(ErrStaleDownload, nil)
+		}
+		return nil, kindError(ErrObjectNotFound, nil)
+	}
+	if gen > 0 && obj.info.Generation != gen {
+		return nil, kindError(ErrStaleDownload, nil)
+	}
+	return obj, nil
+}
+
+// rangeReader returns range reader func for stored object, pinned to given generation when set
+func (ms *memoryStorageClient) rangeReader(bucket, name string, gen int64) rangeReaderFunc {
+	return func(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapStorageError(err, ERROR_STORAGE_CANCELED)
+		}
+		obj, err := ms.readableObject(bucket, name, gen)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(len(obj.data))
+		if off >= size {
+			return nil, io.EOF
+		}
+		end := size
+		if length >= 0 && off+length < end {
+			end = off + length
+		}
+		return io.NopCloser(bytes.NewReader(obj.data[off:end])), nil
+	}
+}
+
+func (ms *memoryStorageClient) ReadAt(ctx context.Context, cfr CloudFileRequest, p []byte, off int64) (int, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	fPath := cfr.objectName()
+	cfr, err := cfr.pinReads(ctx, ms.StatObject)
+	if err != nil {
+		return 0, err
+	}
+
+	co := newCloudObject(ctx, fPath, -1, cfr.generation, ms.rangeReader(cfr.bucket, fPath, cfr.generation))
+	return co.ReadAt(p, off)
+}
+
+func (ms *memoryStorageClient) StatObject(ctx context.Context, cfr CloudFileRequest) (ObjectInfo, error) {
+	if cfr.bucket == "" {
+		return ObjectInfo{}, ErrBucketNameMissing
+	}
+	if cfr.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+
+	obj, err := ms.readableObject(cfr.bucket, cfr.objectName(), 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return cloneObjectInfo(obj.info), nil
+}
+
+func (ms *memoryStorageClient) OpenObject(ctx context.Context, cfr CloudFileRequest) (CloudObject, error) {
+	if cfr.file == "" {
+		return nil, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return nil, ErrBucketNameMissing
+	}
+	fPath := cfr.objectName()
+
+	obj, err := ms.readableObject(cfr.bucket, fPath, cfr.generation)
+	if err != nil {
+		ms.logger.Error("memory file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return nil, err
+	}
+
+	// pin all reads through the handle to opened generation
+	gen := obj.info.Generation
+	return newCloudObject(ctx, fPath, obj.info.Size, gen, ms.rangeReader(cfr.bucket, fPath, gen)), nil
+}
+
+// bucketInfos returns name sorted infos of bucket objects
+func (ms *memoryStorageClient) bucketInfos(bucket string) []ObjectInfo {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	infos := make([]ObjectInfo, 0, len(ms.buckets[bucket]))
+	for _, obj := range ms.buckets[bucket] {
+		infos = append(infos, cloneObjectInfo(obj.info))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (ms *memoryStorageClient) ListObjects(ctx context.Context, req CloudFileRequest) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	return listObjectInfos(ms.bucketInfos(req.bucket), req, 0, "")
+}
+
+func (ms *memoryStorageClient) ListObjectsPage(ctx context.Context, req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	if pageSize <= 0 {
+		return ObjectList{}, ErrInvalidPageSize
+	}
+	return listObjectInfos(ms.bucketInfos(req.bucket), req, pageSize, pageToken)
+}
+
+func (ms *memoryStorageClient) StreamObjects(ctx context.Context, req CloudFileRequest) <-chan ListEntry {
+	list, err := ms.ListObjects(ctx, req)
+	return streamObjectList(ctx, list, err)
+}
+
+func (ms *memoryStorageClient) CopyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	return ms.copyObject(src, dst, false)
+}
+
+func (ms *memoryStorageClient) MoveObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	return ms.copyObject(src, dst, true)
+}
+
+// copyObject copies source to destination, deleting source when moving, atomically
+func (ms *memoryStorageClient) copyObject(src, dst CloudFileRequest, move bool) (ObjectInfo, error) {
+	if src.bucket == "" || dst.bucket == "" {
+		return ObjectInfo{}, ErrBucketNameMissing
+	}
+	if src.file == "" || dst.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+	srcName, dstName := src.objectName(), dst.objectName()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	srcObj := ms.object(src.bucket, srcName)
+	if srcObj == nil {
+		ms.logger.Error("memory file inaccessible", zap.String("filepath", srcName))
+		return ObjectInfo{}, kindError(ErrObjectNotFound, nil)
+	}
+	if src.generation > 0 && srcObj.info.Generation != src.generation {
+		ms.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("src", srcName), zap.Int64("generation", src.generation))
+		return ObjectInfo{}, kindError(ErrStaleDownload, nil)
+	}
+
+	// destination preconditions, modification time applies to uploads only
+	var current *ObjectInfo
+	if obj := ms.object(dst.bucket, dstName); obj != nil {
+		current = &obj.info
+	}
+	dst.modTime = 0
+	if err := checkUploadConditions(dst, current); err != nil {
+		ms.logger.Error(ERROR_STALE_UPLOAD, zap.String("src", srcName), zap.String("dst", dstName))
+		return ObjectInfo{}, err
+	}
+
+	dstObj := ms.newMemoryObject(dst.bucket, dstName, srcObj.data, dst, &srcObj.info)
+	ms.putObject(dstObj)
+	if move && (src.bucket != dst.bucket || srcName != dstName) {
+		delete(ms.buckets[src.bucket], srcName)
+	}
+	ms.logger.Debug("copied memory file", zap.String("src", srcName), zap.String("dst", dstName), zap.Bool("move", move))
+	return cloneObjectInfo(dstObj.info), nil
+}
+
+func (ms *memoryStorageClient) DeleteObject(ctx context.Context, req CloudFileRequest) error {
+	if req.bucket == "" {
+		return ErrBucketNameMissing
+	}
+	if req.path == "" {
+		return ErrFilePathMissing
+	}
+	if req.file == "" {
+		return ErrFileNameMissing
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	objName := req.objectName()
+	if ms.object(req.bucket, objName) == nil {
+		ms.logger.Error(ERROR_DELETING_OBJECT, zap.String("name", objName))
+		return wrapStorageError(kindError(ErrObjectNotFound, nil), ERROR_DELETING_OBJECT)
+	}
+	delete(ms.buckets[req.bucket], objName)
+	return nil
+}
+
+func (ms *memoryStorageClient) DeleteObjects(ctx context.Context, req CloudFileRequest) (DeleteSummary, error) {
+	if err := req.validateList(); err != nil {
+		return DeleteSummary{}, err
+	}
+	// guard against wiping entire bucket
+	if req.path == "" && !req.deleteAll {
+		return DeleteSummary{}, ErrDeletePrefixMissing
+	}
+
+	list, err := listObjectInfos(ms.bucketInfos(req.bucket), req, 0, "")
+	if err != nil {
+		return DeleteSummary{}, err
+	}
+
+	summary := DeleteSummary{
+		DryRun:  req.dryRun,
+		Deleted: []string{},
+		Failed:  []string{},
+		Results: []DeleteResult{},
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, info := range list.Objects {
+		result := DeleteResult{
+			Key:    info.Name,
+			Status: DeleteStatusDeleted,
+		}
+		// delete only listed generation, skip objects replaced since listing
+		obj := ms.object(req.bucket, info.Name)
+		switch {
+		case obj == nil:
+			result.Status = DeleteStatusNotFound
+			result.Err = kindError(ErrObjectNotFound, nil)
+		case obj.info.Generation != info.Generation:
+			result.Status = DeleteStatusPreconditionFailed
+			result.Err = kindError(ErrPreconditionFailed, nil)
+		case !req.dryRun:
+			delete(ms.buckets[req.bucket], info.Name)
+		}
+
+		summary.add(result)
+	}
+	ms.logger.Info("deleted objects", zap.String("prefix", req.listPrefix()), zap.Bool("dryRun", req.dryRun), zap.Int("deleted", len(summary.Deleted)), zap.Int("failed", len(summary.Failed)))
+	if len(summary.Failed) > 0 {
+		return summary, ErrDeleteIncomplete
+	}
+	return summary, nil
+}
+
+func (ms *memoryStorageClient) Close() error {
+	return nil
+}
+
+// cloneObjectInfo returns a copy of given object info not sharing metadata or checksum
+func cloneObjectInfo(info ObjectInfo) ObjectInfo {
+	info.Metadata = copyMetadata(info.Metadata)
+	if info.MD5 != nil {
+		info.MD5 = append([]byte(nil), info.MD5...)
+	}
+	return info
+}
+
+// copyMetadata returns a copy of given metadata, nil for nil
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		cp[k] = v
+	}
+	return cp
+}
@@ -0,0 +1,85 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryFileStorage(t *testing.T) {
+	runStorageScenarios(t, func(t *testing.T, testCfg *testConfig) (CloudStorage, func()) {
+		client, err := NewMemoryStorageClient(logger.NewTestAppLogger(testCfg.dir))
+		require.NoError(t, err)
+		return client, func() {
+			err := client.Close()
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestMemoryListObjectsPaging(t *testing.T) {
+	client, err := NewMemoryStorageClient(logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, name := range []string{"data/a.json", "data/b.json", "data/c.csv", "data/sub/d.json", "data/sub/e.json"} {
+		cfr, err := NewCloudFileRequest("test-bucket", name, "", 0)
+		require.NoError(t, err)
+		_, err = client.UploadFile(ctx, bytes.NewReader([]byte(name)), cfr)
+		require.NoError(t, err)
+	}
+
+	cfr, err := NewCloudFileRequest("test-bucket", "", "data", 0, WithDelimiter("/"))
+	require.NoError(t, err)
+	list, err := client.ListObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(list.Objects))
+	require.Equal(t, []string{"data/sub/"}, list.Prefixes)
+
+	names := []string{}
+	token := ""
+	for {
+		page, err := client.ListObjectsPage(ctx, cfr, 2, token)
+		require.NoError(t, err)
+		for _, obj := range page.Objects {
+			names = append(names, obj.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	require.Equal(t, []string{"data/a.json", "data/b.json", "data/c.csv"}, names)
+
+	globCfr, err := NewCloudFileRequest("test-bucket", "", "data", 0, WithGlob("data/*.json"), WithDelimiter("/"))
+	require.NoError(t, err)
+	list, err = client.ListObjects(ctx, globCfr)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list.Objects))
+
+	// glob matches full object names, not names relative to request path
+	for glob, expected := range map[string][]string{
+		"*.json":          {},
+		"data/*.json":     {"data/a.json", "data/b.json"},
+		"data/*":          {"data/a.json", "data/b.json", "data/c.csv"},
+		"data/sub/?.json": {"data/sub/d.json", "data/sub/e.json"},
+	} {
+		globCfr, err := NewCloudFileRequest("test-bucket", "", "data", 0, WithGlob(glob))
+		require.NoError(t, err)
+		list, err = client.ListObjects(ctx, globCfr)
+		require.NoError(t, err)
+		names := []string{}
+		for _, obj := range list.Objects {
+			names = append(names, obj.Name)
+		}
+		require.Equal(t, expected, names, glob)
+	}
+
+	_, err = client.ListObjectsPage(ctx, cfr, 2, "not a token!")
+	require.ErrorIs(t, err, ErrInvalidPageToken)
+}
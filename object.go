@@ -0,0 +1,322 @@
+package cloudstorage
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+)
+
+// CloudObject is a read handle for a cloud object,
+// object attributes are fetched once, when the handle is opened
+type CloudObject interface {
+	io.ReaderAt
+	io.ReadSeeker
+	io.Closer
+	// Size returns object size in bytes
+	Size() int64
+	// Generation returns object generation the handle was opened for
+	Generation() int64
+}
+
+// ObjectInfo holds cloud object attributes
+type ObjectInfo struct {
+	Bucket          string
+	Name            string
+	Size            int64
+	ContentType     string
+	ContentEncoding string
+	Generation      int64
+	Metageneration  int64
+	StorageClass    string
+	ETag            string
+	CRC32C          uint32
+	MD5             []byte
+	Created         time.Time
+	Updated         time.Time
+	Metadata        map[string]string
+}
+
+// newObjectInfo takes storage object attributes, returns object info
+func newObjectInfo(attrs *storage.ObjectAttrs) ObjectInfo {
+	return ObjectInfo{
+		Bucket:          attrs.Bucket,
+		Name:            attrs.Name,
+		Size:            attrs.Size,
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		Generation:      attrs.Generation,
+		Metageneration:  attrs.Metageneration,
+		StorageClass:    attrs.StorageClass,
+		ETag:            attrs.Etag,
+		CRC32C:          attrs.CRC32C,
+		MD5:             attrs.MD5,
+		Created:         attrs.Created,
+		Updated:         attrs.Updated,
+		Metadata:        attrs.Metadata,
+	}
+}
+
+// rangeReaderFunc opens a reader for length bytes of object data at given offset,
+// negative length reads till end of object, offset past end of object returns io.EOF
+type rangeReaderFunc func(ctx context.Context, off, length int64) (io.ReadCloser, error)
+
+type cloudObject struct {
+	ctx            context.Context
+	name           string
+	size           int64
+	generation     int64
+	newRangeReader rangeReaderFunc
+
+	mu     sync.Mutex
+	offset int64
+	rc     io.ReadCloser
+	closed bool
+}
+
+// newCloudObject takes context, object name, size, generation & range reader func, returns object handle,
+// negative size indicates unknown object size
+func newCloudObject(ctx context.Context, name string, size, generation int64, fn rangeReaderFunc) *cloudObject {
+	return &cloudObject{
+		ctx:            ctx,
+		name:           name,
+		size:           size,
+		generation:     generation,
+		newRangeReader: fn,
+	}
+}
+
+func (co *cloudObject) Size() int64 {
+	return co.size
+}
+
+func (co *cloudObject) Generation() int64 {
+	return co.generation
+}
+
+// ReadAt reads len(p) bytes at given offset, fetching only the requested range,
+// safe for concurrent use & independent of Read/Seek offset
+func (co *cloudObject) ReadAt(p []byte, off int64) (int, error) {
+	co.mu.Lock()
+	closed := co.closed
+	co.mu.Unlock()
+
+	if closed {
+		return 0, ErrObjectClosed
+	}
+	if off < 0 {
+		return 0, ErrInvalidOffset
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	length := int64(len(p))
+	if co.size >= 0 {
+		if off >= co.size {
+			return 0, io.EOF
+		}
+		if off+length > co.size {
+			length = co.size - off
+		}
+	}
+
+	rc, err := co.newRangeReader(co.ctx, off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	// fill p fully or report why not
+	n, err := io.ReadFull(rc, p[:length])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return n, io.EOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads sequentially from current offset, reusing one reader until next Seek
+func (co *cloudObject) Read(p []byte) (int, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.closed {
+		return 0, ErrObjectClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if co.size >= 0 && co.offset >= co.size {
+		return 0, io.EOF
+	}
+
+	if co.rc == nil {
+		rc, err := co.newRangeReader(co.ctx, co.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		co.rc = rc
+	}
+
+	n, err := co.rc.Read(p)
+	co.offset += int64(n)
+	return n, err
+}
+
+// Seek sets offset for next Read, ReadAt is not affected
+func (co *cloudObject) Seek(offset int64, whence int) (int64, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.closed {
+		return 0, ErrObjectClosed
+	}
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = co.offset + offset
+	case io.SeekEnd:
+		if co.size < 0 {
+			return 0, ErrInvalidSeek
+		}
+		abs = co.size + offset
+	default:
+		return 0, ErrInvalidSeek
+	}
+	if abs < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	// drop current reader, next Read opens a new one from new offset
+	if abs != co.offset && co.rc != nil {
+		if err := co.rc.Close(); err != nil {
+			return 0, wrapStorageError(err, "error closing cloud file reader %s", co.name)
+		}
+		co.rc = nil
+	}
+	co.offset = abs
+	return abs, nil
+}
+
+func (co *cloudObject) Close() error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.closed {
+		return nil
+	}
+	co.closed = true
+	if co.rc != nil {
+		err := co.rc.Close()
+		co.rc = nil
+		if err != nil {
+			return wrapStorageError(err, "error closing cloud file reader %s", co.name)
+		}
+	}
+	return nil
+}
+
+// OpenObject takes cloud file request, returns object handle with cached object attributes
+func (cs *cloudStorageClient) OpenObject(ctx context.Context, cfr CloudFileRequest) (CloudObject, error) {
+	if cfr.file == "" {
+		return nil, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return nil, ErrBucketNameMissing
+	}
+
+	fPath := cfr.file
+	if cfr.path != "" {
+		fPath = filepath.Join(cfr.path, cfr.file)
+	}
+
+	// attributes call is bounded by metadata timeout, handle reads outlive it & are bounded by caller context only
+	attrsCtx, cancel := cfr.withTimeout(ctx, cs.config.MetadataTimeout)
+	defer cancel()
+
+	obj := cs.object(cfr.bucket, fPath)
+	var attrs *storage.ObjectAttrs
+	err := cs.retry.retry(attrsCtx, cs.logger, "stat", true, func(attempt int) error {
+		var err error
+		attrs, err = obj.Attrs(attrsCtx)
+		return err
+	})
+	if err != nil {
+		cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return nil, wrapStorageError(err, "cloud file inaccessible %s", fPath)
+	}
+	if cfr.generation > 0 && attrs.Generation != cfr.generation {
+		cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("filepath", fPath), zap.Int64("generation", cfr.generation), zap.Int64("current", attrs.Generation))
+		return nil, kindError(ErrStaleDownload, nil)
+	}
+	cs.logger.Debug("opened cloud file", zap.String("filepath", fPath), zap.Int64("size", attrs.Size), zap.Int64("generation", attrs.Generation))
+
+	// pin all reads through the handle to opened generation
+	return newCloudObject(ctx, fPath, attrs.Size, attrs.Generation, gcsRangeReader(obj, attrs.Generation)), nil
+}
+
+// StatObject takes cloud file request, returns object info or object not found error
+func (cs *cloudStorageClient) StatObject(ctx context.Context, cfr CloudFileRequest) (ObjectInfo, error) {
+	if cfr.bucket == "" {
+		return ObjectInfo{}, ErrBucketNameMissing
+	}
+	if cfr.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+
+	ctx, cancel := cfr.withTimeout(ctx, cs.config.MetadataTimeout)
+	defer cancel()
+
+	fPath := cfr.objectName()
+	var attrs *storage.ObjectAttrs
+	err := cs.retry.retry(ctx, cs.logger, "stat", true, func(attempt int) error {
+		var err error
+		attrs, err = cs.object(cfr.bucket, fPath).Attrs(ctx)
+		return err
+	})
+	if err != nil {
+		if isKind(err, storage.ErrObjectNotExist) {
+			cs.logger.Debug(ERROR_OBJECT_NOT_FOUND, zap.String("filepath", fPath))
+			return ObjectInfo{}, kindError(ErrObjectNotFound, err)
+		}
+		cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return ObjectInfo{}, wrapStorageError(err, "cloud file inaccessible %s", fPath)
+	}
+	return newObjectInfo(attrs), nil
+}
+
+// gcsRangeReader returns range reader func for given object handle,
+// reads are pinned to given generation when set
+func gcsRangeReader(obj *storage.ObjectHandle, gen int64) rangeReaderFunc {
+	if gen > 0 {
+		obj = obj.If(storage.Conditions{GenerationMatch: gen})
+	}
+	return func(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+		// read compressed to keep ranges aligned with stored bytes for gzip encoded objects
+		rc, err := obj.ReadCompressed(true).NewRangeReader(ctx, off, length)
+		if err != nil {
+			if isRangeNotSatisfiable(err) {
+				return nil, io.EOF
+			}
+			// pinned object replaced or removed
+			if gen > 0 && (isPreconditionFailed(err) || isKind(err, storage.ErrObjectNotExist)) {
+				return nil, kindError(ErrStaleDownload, err)
+			}
+			return nil, wrapStorageError(err, "error reading cloud file %s", obj.ObjectName())
+		}
+		return rc, nil
+	}
+}
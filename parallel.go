@@ -0,0 +1,505 @@
+package cloudstorage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// DEFAULT_PART_SIZE is size of parts uploaded concurrently by parallel uploads
+	DEFAULT_PART_SIZE = 4 * SixteenMB
+	// DEFAULT_PARALLEL_WORKERS is number of concurrent part transfers
+	DEFAULT_PARALLEL_WORKERS = 8
+	// MAX_COMPOSE_SOURCES is max number of objects composed by a single compose call
+	MAX_COMPOSE_SOURCES = 32
+	// PARALLEL_UPLOAD_PREFIX is default bucket prefix of temporary parallel upload parts
+	PARALLEL_UPLOAD_PREFIX = ".parallel-uploads/"
+)
+
+// ParallelUploader is implemented by storage clients supporting concurrent part uploads
+type ParallelUploader interface {
+	// UploadFileParallel uploads file of given size to given cloud bucket & filepath, in parts uploaded concurrently
+	// & composed into the object, e.g. an *os.File. Returns stale upload error if request preconditions don't hold
+	UploadFileParallel(ctx context.Context, file io.ReaderAt, size int64, cfr CloudFileRequest) (int64, error)
+}
+
+// ParallelDownloader is implemented by storage clients supporting concurrent range downloads
+type ParallelDownloader interface {
+	// DownloadFileParallel downloads file at given cloud bucket & filepath into given file, e.g. an *os.File,
+	// fetching ranges concurrently from the same object generation, & verifies downloaded file checksum
+	DownloadFileParallel(ctx context.Context, file io.WriterAt, cfr CloudFileRequest) (int64, error)
+}
+
+// WithPartSize sets part size of parallel transfers
+func WithPartSize(size BufferSize) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.partSize = size
+	}
+}
+
+// WithTempPrefix sets bucket prefix of temporary parallel upload parts, PARALLEL_UPLOAD_PREFIX by default
+func WithTempPrefix(prefix string) CloudFileRequestOption {
+	return func(cfr *CloudFileRequest) {
+		cfr.tempPrefix = prefix
+	}
+}
+
+// composeSource is an uploaded part or intermediate composite, pinned to its generation
+type composeSource struct {
+	name       string
+	generation int64
+}
+
+// UploadFileParallel uploads parts as temporary objects under request temp prefix, PARALLEL_UPLOAD_PREFIX by default,
+// with request concurrency, composes parts 32 at a time, through intermediate composites for more than 32 parts,
+// & deletes temporary objects once done or failed. Temporary objects are in destination bucket, so they show up
+// in its listings while upload runs. Each part upload & compose call is bounded by transfer timeout.
+// Files of a single part are uploaded with UploadFile
+func (cs *cloudStorageClient) UploadFileParallel(ctx context.Context, file io.ReaderAt, size int64, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	if size < 0 {
+		return 0, ErrInvalidSize
+	}
+	fPath := cfr.objectName()
+
+	partSize := int64(cfr.partSize)
+	if partSize <= 0 {
+		partSize = int64(DEFAULT_PART_SIZE)
+	}
+	parts := int((size + partSize - 1) / partSize)
+	if parts <= 1 {
+		return cs.UploadFile(ctx, io.NewSectionReader(file, 0, size), cfr)
+	}
+	workers := cfr.concurrency
+	if workers <= 0 {
+		workers = DEFAULT_PARALLEL_WORKERS
+	}
+
+	// fail fast, before uploading parts, if request preconditions already fail
+	sCtx, cancel := cfr.withTimeout(ctx, cs.config.MetadataTimeout)
+	defer cancel()
+	conds, err := cs.uploadPreconditions(sCtx, cfr, fPath)
+	if err != nil {
+		return 0, err
+	}
+
+	attrs := storage.ObjectAttrs{}
+	cfr.applyAttrs(&attrs)
+	if attrs.ContentType == "" {
+		if attrs.ContentType, err = sniffContentType(io.NewSectionReader(file, 0, size)); err != nil {
+			cs.logger.Error("error reading file", zap.Error(err), zap.String("filepath", fPath))
+			return 0, wrapStorageError(err, "error reading file %s", fPath)
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return 0, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	prefix := cfr.tempPrefix
+	if prefix == "" {
+		prefix = PARALLEL_UPLOAD_PREFIX
+	}
+	tmpPrefix := fmt.Sprintf("%s%s/%s/", prefix, fPath, hex.EncodeToString(id))
+
+	// temporary objects are deleted whether upload succeeds or fails
+	var tmpMu sync.Mutex
+	tmpNames := []string{}
+	addTmp := func(name string) {
+		tmpMu.Lock()
+		defer tmpMu.Unlock()
+		tmpNames = append(tmpNames, name)
+	}
+	defer func() {
+		cs.deleteTempObjects(cfr, tmpPrefix, tmpNames, workers)
+	}()
+
+	cs.logger.Debug("uploading file parts", zap.String("filepath", fPath), zap.Int64("size", size), zap.Int("parts", parts), zap.Int("workers", workers))
+	sources := make([]composeSource, parts)
+	err = runParallel(ctx, workers, parts, func(ctx context.Context, i int) error {
+		name := fmt.Sprintf("%spart-%05d", tmpPrefix, i)
+		addTmp(name)
+		off := int64(i) * partSize
+		n := partSize
+		if off+n > size {
+			n = size - off
+		}
+		gen, err := cs.uploadPart(ctx, cfr, name, io.NewSectionReader(file, off, n))
+		if err != nil {
+			return err
+		}
+		sources[i] = composeSource{name: name, generation: gen}
+		return nil
+	})
+	if err != nil {
+		cs.logger.Error("error uploading file parts", zap.Error(err), zap.String("filepath", fPath))
+		return 0, err
+	}
+
+	// compose at most MAX_COMPOSE_SOURCES objects per call, level by level
+	for level := 1; len(sources) > MAX_COMPOSE_SOURCES; level++ {
+		groups := (len(sources) + MAX_COMPOSE_SOURCES - 1) / MAX_COMPOSE_SOURCES
+		composites := make([]composeSource, groups)
+		err = runParallel(ctx, workers, groups, func(ctx context.Context, g int) error {
+			name := fmt.Sprintf("%scompose-%d-%05d", tmpPrefix, level, g)
+			addTmp(name)
+			end := (g + 1) * MAX_COMPOSE_SOURCES
+			if end > len(sources) {
+				end = len(sources)
+			}
+			// intermediate composites are temporary, replacing them on retry is harmless
+			objAttrs, err := cs.compose(ctx, cfr, cs.object(cfr.bucket, name), sources[g*MAX_COMPOSE_SOURCES:end], storage.ObjectAttrs{}, true)
+			if err != nil {
+				return err
+			}
+			composites[g] = composeSource{name: name, generation: objAttrs.Generation}
+			return nil
+		})
+		if err != nil {
+			cs.logger.Error(ERROR_COMPOSING_OBJECT, zap.Error(err), zap.String("filepath", fPath), zap.Int("level", level))
+			return 0, err
+		}
+		sources = composites
+	}
+
+	dst := cs.object(cfr.bucket, fPath)
+	if conds != nil {
+		dst = dst.If(*conds)
+	}
+	objAttrs, err := cs.compose(ctx, cfr, dst, sources, attrs, conds != nil)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			cs.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("filepath", fPath))
+			return 0, kindError(ErrStaleUpload, err)
+		}
+		cs.logger.Error(ERROR_COMPOSING_OBJECT, zap.Error(err), zap.String("filepath", fPath))
+		return 0, err
+	}
+	cs.logger.Debug("cloud file created/updated", zap.String("filepath", fPath), zap.Int64("generation", objAttrs.Generation), zap.Int("parts", parts))
+	return objAttrs.Size, nil
+}
+
+// uploadPart uploads part to temporary object, retried from part start, returns part generation
+func (cs *cloudStorageClient) uploadPart(ctx context.Context, cfr CloudFileRequest, name string, part *io.SectionReader) (int64, error) {
+	buf := cs.copyBuffer(cfr)
+	chunkSize := cs.chunkSize(cfr)
+	var gen int64
+	err := cs.retry.retry(ctx, cs.logger, "upload part", true, func(attempt int) error {
+		if _, err := part.Seek(0, io.SeekStart); err != nil {
+			return wrapStorageError(err, "error rewinding file part %s", name)
+		}
+
+		// on copy error, cancel aborts the upload
+		wCtx, cancel := cfr.withTimeout(ctx, cs.config.TransferTimeout)
+		defer cancel()
+		wc := cs.object(cfr.bucket, name).NewWriter(wCtx)
+		if chunkSize < 0 {
+			wc.ChunkSize = 0
+		} else if chunkSize > 0 {
+			wc.ChunkSize = int(chunkSize)
+		}
+		if _, err := io.CopyBuffer(wc, part, buf); err != nil {
+			cs.logger.Error("error uploading file part", zap.Error(err), zap.String("name", name), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error uploading file part %s", name)
+		}
+		if err := wc.Close(); err != nil {
+			cs.logger.Error("error closing file part", zap.Error(err), zap.String("name", name), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error closing file part %s", name)
+		}
+		gen = wc.Attrs().Generation
+		return nil
+	})
+	return gen, err
+}
+
+// compose composes given sources, in order, into destination object with given attributes
+func (cs *cloudStorageClient) compose(ctx context.Context, cfr CloudFileRequest, dst *storage.ObjectHandle, sources []composeSource, attrs storage.ObjectAttrs, idempotent bool) (*storage.ObjectAttrs, error) {
+	srcs := make([]*storage.ObjectHandle, len(sources))
+	for i, src := range sources {
+		srcs[i] = cs.object(cfr.bucket, src.name).Generation(src.generation)
+	}
+
+	var objAttrs *storage.ObjectAttrs
+	err := cs.retry.retry(ctx, cs.logger, "compose", idempotent, func(attempt int) error {
+		cCtx, cancel := cfr.withTimeout(ctx, cs.config.TransferTimeout)
+		defer cancel()
+		composer := dst.ComposerFrom(srcs...)
+		composer.ObjectAttrs = attrs
+		var err error
+		objAttrs, err = composer.Run(cCtx)
+		return err
+	})
+	if err != nil {
+		return nil, wrapStorageError(err, ERROR_COMPOSING_OBJECT)
+	}
+	return objAttrs, nil
+}
+
+// deleteTempObjects deletes temporary upload objects, bounded by metadata timeout rather than upload context,
+// so parts are cleaned up after cancelled uploads. Failures are logged only
+func (cs *cloudStorageClient) deleteTempObjects(cfr CloudFileRequest, prefix string, names []string, workers int) {
+	ctx, cancel := cfr.withTimeout(context.Background(), cs.config.MetadataTimeout)
+	defer cancel()
+
+	var failed int32
+	_ = runParallel(ctx, workers, len(names), func(ctx context.Context, i int) error {
+		err := cs.retry.retry(ctx, cs.logger, "delete part", true, func(attempt int) error {
+			return cs.object(cfr.bucket, names[i]).Delete(ctx)
+		})
+		if err != nil && !isKind(err, storage.ErrObjectNotExist) {
+			cs.logger.Error("error deleting temporary upload object", zap.Error(err), zap.String("name", names[i]))
+			atomic.AddInt32(&failed, 1)
+		}
+		return nil
+	})
+	if failed > 0 {
+		cs.logger.Error("temporary upload objects left behind", zap.String("bucket", cfr.bucket), zap.String("prefix", prefix), zap.Int("failed", int(failed)))
+	}
+}
+
+// DownloadFileParallel downloads ranges of request part size with request concurrency, pinned to generation current
+// when download starts, or request generation. Each range is bounded by transfer timeout & retried from its copied offset.
+// Returns checksum mismatch error if CRC32C of downloaded data doesn't match object checksum
+func (cs *cloudStorageClient) DownloadFileParallel(ctx context.Context, file io.WriterAt, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	fPath := cfr.objectName()
+
+	obj := cs.object(cfr.bucket, fPath)
+	var attrs *storage.ObjectAttrs
+	err := cs.retry.retry(ctx, cs.logger, "stat", true, func(attempt int) error {
+		sCtx, cancel := cfr.withTimeout(ctx, cs.config.MetadataTimeout)
+		defer cancel()
+		var err error
+		attrs, err = obj.Attrs(sCtx)
+		return err
+	})
+	if err != nil {
+		cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "cloud file inaccessible %s", fPath)
+	}
+	if cfr.generation > 0 && attrs.Generation != cfr.generation {
+		cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("filepath", fPath), zap.Int64("generation", cfr.generation), zap.Int64("current", attrs.Generation))
+		return 0, kindError(ErrStaleDownload, nil)
+	}
+
+	// stored bytes, without decompressive transcoding, match object size & checksum
+	obj = obj.Generation(attrs.Generation).ReadCompressed(true)
+
+	partSize := int64(cfr.partSize)
+	if partSize <= 0 {
+		partSize = int64(DEFAULT_PART_SIZE)
+	}
+	parts := int((attrs.Size + partSize - 1) / partSize)
+	workers := cfr.concurrency
+	if workers <= 0 {
+		workers = DEFAULT_PARALLEL_WORKERS
+	}
+
+	cs.logger.Debug("downloading cloud file ranges", zap.String("filepath", fPath), zap.Int64("size", attrs.Size), zap.Int64("generation", attrs.Generation), zap.Int("parts", parts), zap.Int("workers", workers))
+	crcs := make([]uint32, parts)
+	err = runParallel(ctx, workers, parts, func(ctx context.Context, i int) error {
+		off := int64(i) * partSize
+		n := partSize
+		if off+n > attrs.Size {
+			n = attrs.Size - off
+		}
+		crc, err := cs.downloadRange(ctx, cfr, obj, file, off, n)
+		if err != nil {
+			return err
+		}
+		crcs[i] = crc
+		return nil
+	})
+	if err != nil {
+		cs.logger.Error("error downloading cloud file ranges", zap.Error(err), zap.String("filepath", fPath))
+		return 0, err
+	}
+
+	var crc uint32
+	for i, partCRC := range crcs {
+		n := partSize
+		if i == parts-1 {
+			n = attrs.Size - int64(i)*partSize
+		}
+		crc = crc32Combine(crc, partCRC, n)
+	}
+	if crc != attrs.CRC32C {
+		cs.logger.Error(ERROR_CHECKSUM_MISMATCH, zap.String("filepath", fPath), zap.Uint32("crc32c", crc), zap.Uint32("expected", attrs.CRC32C))
+		return 0, ErrChecksumMismatch
+	}
+	return attrs.Size, nil
+}
+
+// downloadRange copies object range into file at range offset, retried from copied offset, returns range CRC32C
+func (cs *cloudStorageClient) downloadRange(ctx context.Context, cfr CloudFileRequest, obj *storage.ObjectHandle, file io.WriterAt, off, n int64) (uint32, error) {
+	fPath := cfr.objectName()
+	buf := cs.copyBuffer(cfr)
+	crc := crc32.New(crc32cTable)
+	var copied int64
+	err := cs.retry.retry(ctx, cs.logger, "download range", true, func(attempt int) error {
+		rCtx, cancel := cfr.withTimeout(ctx, cs.config.TransferTimeout)
+		defer cancel()
+		rc, err := obj.NewRangeReader(rCtx, off+copied, n-copied)
+		if err != nil {
+			// pinned generation is gone once object is replaced
+			if isPreconditionFailed(err) || isKind(err, storage.ErrObjectNotExist) {
+				cs.logger.Error(ERROR_STALE_DOWNLOAD, zap.String("filepath", fPath), zap.Int64("offset", off))
+				return kindError(ErrStaleDownload, err)
+			}
+			cs.logger.Error("error reading cloud file", zap.Error(err), zap.String("filepath", fPath), zap.Int64("offset", off+copied), zap.Int("attempt", attempt))
+			return wrapStorageError(err, "error reading cloud file %s", fPath)
+		}
+		defer func() {
+			if err := rc.Close(); err != nil {
+				cs.logger.Error("error closing cloud file", zap.Error(err), zap.String("filepath", fPath))
+			}
+		}()
+
+		for copied < n {
+			m, err := rc.Read(buf)
+			if m > 0 {
+				if _, err := file.WriteAt(buf[:m], off+copied); err != nil {
+					cs.logger.Error("error writing file", zap.Error(err), zap.String("filepath", fPath), zap.Int64("offset", off+copied))
+					return wrapStorageError(err, "error writing file %s", fPath)
+				}
+				crc.Write(buf[:m])
+				copied += int64(m)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				cs.logger.Error("error copying cloud file", zap.Error(err), zap.String("filepath", fPath), zap.Int64("offset", off+copied), zap.Int("attempt", attempt))
+				return wrapStorageError(err, "error copying cloud file %s", fPath)
+			}
+		}
+		if copied < n {
+			return wrapStorageError(io.ErrUnexpectedEOF, "error copying cloud file %s", fPath)
+		}
+		return nil
+	})
+	return crc.Sum32(), err
+}
+
+// crc32Combine returns CRC32C of concatenated data, given CRC32C of first data & of second data of given length,
+// as zlib crc32_combine
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1 ^ crc2
+	}
+
+	// odd is operator for one zero bit, even for two zero bits
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for i := 1; i < 32; i++ {
+		odd[i] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(&even, &odd)
+	gf2MatrixSquare(&odd, &even)
+
+	// apply len2 zero bytes to crc1
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for i := 0; i < 32; i++ {
+		square[i] = gf2MatrixTimes(mat, mat[i])
+	}
+}
+
+// runParallel calls fn for indexes 0 to n-1 with at most given number of concurrent workers,
+// returns first error, which cancels fn context & stops further calls
+func runParallel(ctx context.Context, workers, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if workers > n {
+		workers = n
+	}
+
+	var once sync.Once
+	var firstErr error
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+			break feed
+		case indexes <- i:
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return wrapStorageError(err, ERROR_STORAGE_CANCELED)
+	}
+	return nil
+}
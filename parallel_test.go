@@ -0,0 +1,565 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGCSObject is an object stored by fakeGCS
+type fakeGCSObject struct {
+	data       []byte
+	generation int64
+}
+
+// fakeGCSCompose is a compose call received by fakeGCS
+type fakeGCSCompose struct {
+	name    string
+	sources []composeSource
+	query   url.Values
+}
+
+// fakeGCS is a GCS JSON API endpoint for multipart uploads, compose, stat & delete of objects,
+// & XML API endpoint for range reads. Hooks are called with lock held & may change objects with put
+type fakeGCS struct {
+	mu       sync.Mutex
+	gen      int64
+	objects  map[string]*fakeGCSObject
+	uploads  []string
+	composes []fakeGCSCompose
+	// reads are generations range reads are pinned to
+	reads []string
+	// failUpload fails upload of named object with service unavailable
+	failUpload func(name string) bool
+	// afterUpload is called after named object is uploaded
+	afterUpload func(name string)
+	// onRead is called with range of named object before it's served, & may change served data
+	onRead func(name string, start int64, data []byte)
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{
+		gen:     1000,
+		objects: map[string]*fakeGCSObject{},
+	}
+}
+
+// put stores object as a new generation, caller must hold lock
+func (f *fakeGCS) put(bucket, name string, data []byte) *fakeGCSObject {
+	f.gen++
+	obj := &fakeGCSObject{data: data, generation: f.gen}
+	f.objects[bucket+"/"+name] = obj
+	return obj
+}
+
+// names returns names of stored objects of bucket with given prefix
+func (f *fakeGCS) names(bucket, prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for key := range f.objects {
+		if name := strings.TrimPrefix(key, bucket+"/"); name != key && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// object returns stored object data, nil if there is none
+func (f *fakeGCS) object(bucket, name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if obj, ok := f.objects[bucket+"/"+name]; ok {
+		return obj.data
+	}
+	return nil
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/") {
+		bucket, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/")
+		f.insert(w, r, bucket)
+		return
+	}
+
+	if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/storage/v1/") {
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		f.read(w, r, bucket, name)
+		return
+	}
+
+	// object names are escaped path segments of JSON API paths
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1/b/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/storage/v1/b/") || len(segments) < 3 || segments[1] != "o" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bucket := segments[0]
+	name, err := url.PathUnescape(segments[2])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	obj, ok := f.objects[bucket+"/"+name]
+
+	switch {
+	case len(segments) == 4 && segments[3] == "compose" && r.Method == http.MethodPost:
+		f.compose(w, r, bucket, name)
+	case len(segments) == 3 && r.Method == http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeFakeGCSObject(w, bucket, name, obj)
+	case len(segments) == 3 && r.Method == http.MethodDelete:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.objects, bucket+"/"+name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// insert stores object of a multipart upload, JSON metadata followed by media
+func (f *fakeGCS) insert(w http.ResponseWriter, r *http.Request, bucket string) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" || !strings.HasPrefix(mediaType, "multipart/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta gcsUploadMetadata
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&meta)
+	}
+	var data []byte
+	if err == nil {
+		if part, err = mr.NextPart(); err == nil {
+			data, err = io.ReadAll(part)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = meta.Name
+	}
+
+	f.uploads = append(f.uploads, name)
+	if f.failUpload != nil && f.failUpload(name) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	obj := f.put(bucket, name, data)
+	if f.afterUpload != nil {
+		f.afterUpload(name)
+	}
+	writeFakeGCSObject(w, bucket, name, obj)
+}
+
+// compose concatenates source objects of pinned generations, at most MAX_COMPOSE_SOURCES,
+// into destination object, if destination generation precondition holds
+func (f *fakeGCS) compose(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	var req struct {
+		SourceObjects []struct {
+			Name       string `json:"name"`
+			Generation int64  `json:"generation,string"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.SourceObjects) > MAX_COMPOSE_SOURCES {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	call := fakeGCSCompose{name: name, query: r.URL.Query()}
+	data := []byte{}
+	for _, src := range req.SourceObjects {
+		call.sources = append(call.sources, composeSource{name: src.Name, generation: src.Generation})
+		obj, ok := f.objects[bucket+"/"+src.Name]
+		if !ok || (src.Generation > 0 && obj.generation != src.Generation) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data = append(data, obj.data...)
+	}
+	f.composes = append(f.composes, call)
+
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" {
+		gen, _ := strconv.ParseInt(match, 10, 64)
+		cur, ok := f.objects[bucket+"/"+name]
+		if (gen == 0 && ok) || (gen != 0 && (!ok || cur.generation != gen)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+	writeFakeGCSObject(w, bucket, name, f.put(bucket, name, data))
+}
+
+// read serves object range of requested generation, not found once generation is replaced
+func (f *fakeGCS) read(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	gen := r.URL.Query().Get("generation")
+	f.reads = append(f.reads, gen)
+	obj, ok := f.objects[bucket+"/"+name]
+	if !ok || (gen != "" && gen != strconv.FormatInt(obj.generation, 10)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Range is bytes=start-end
+	start, end := int64(0), int64(len(obj.data)-1)
+	if rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); rng != "" {
+		startStr, endStr, _ := strings.Cut(rng, "-")
+		start, _ = strconv.ParseInt(startStr, 10, 64)
+		if endStr != "" {
+			end, _ = strconv.ParseInt(endStr, 10, 64)
+		}
+	}
+	if start > end || end >= int64(len(obj.data)) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	data := append([]byte{}, obj.data[start:end+1]...)
+	generation := obj.generation
+	if f.onRead != nil {
+		f.onRead(name, start, data)
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(generation, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(data)
+}
+
+// writeFakeGCSObject writes JSON API object resource
+func writeFakeGCSObject(w http.ResponseWriter, bucket, name string, obj *fakeGCSObject) {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(obj.data, crc32cTable))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"kind":           "storage#object",
+		"bucket":         bucket,
+		"name":           name,
+		"size":           strconv.Itoa(len(obj.data)),
+		"generation":     strconv.FormatInt(obj.generation, 10),
+		"metageneration": "1",
+		"crc32c":         base64.StdEncoding.EncodeToString(crc),
+		"updated":        time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func newParallelTestClient(t *testing.T, endpoint string) *cloudStorageClient {
+	client, err := NewCloudStorageClient(CloudStorageClientConfig{
+		Endpoint:  endpoint,
+		Anonymous: true,
+		Retry:     &RetryPolicy{MaxAttempts: 1},
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+	return client
+}
+
+func TestRunParallel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// all calls are made with bounded concurrency
+	var mu sync.Mutex
+	var running, maxRunning int32
+	seen := map[int]bool{}
+	err := runParallel(ctx, 3, 20, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		defer mu.Unlock()
+		if n > maxRunning {
+			maxRunning = n
+		}
+		seen[i] = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 20, len(seen))
+	require.Equal(t, true, maxRunning <= 3)
+
+	// first error cancels remaining calls
+	unavailable := &responseError{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}
+	var calls int32
+	err = runParallel(ctx, 2, 100, func(ctx context.Context, i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 1 {
+			return unavailable
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.Equal(t, unavailable, err)
+	require.Equal(t, true, calls < 100)
+
+	// cancelled context stops calls
+	cCtx, cCancel := context.WithCancel(ctx)
+	cCancel()
+	err = runParallel(cCtx, 2, 10, func(ctx context.Context, i int) error {
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, ErrCanceled)
+
+	require.NoError(t, runParallel(ctx, 4, 0, func(ctx context.Context, i int) error {
+		return nil
+	}))
+}
+
+func TestUploadFileParallel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := newFakeGCS()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := newParallelTestClient(t, srv.URL)
+
+	// 71 parts are composed through 3 intermediate composites
+	data := bytes.Repeat([]byte("0123456789abcdef"), 70*64+10)
+	cfr, err := NewCloudFileRequest("test-bucket", "large.bin", "parallel", 0, WithPartSize(OneKB), WithConcurrency(4))
+	require.NoError(t, err)
+	n, err := client.UploadFileParallel(ctx, bytes.NewReader(data), int64(len(data)), cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, fake.object("test-bucket", "parallel/large.bin"))
+	require.Equal(t, 71, len(fake.uploads))
+	require.Equal(t, 4, len(fake.composes))
+	for _, call := range fake.composes {
+		require.Equal(t, true, len(call.sources) <= MAX_COMPOSE_SOURCES)
+		for _, src := range call.sources {
+			require.Equal(t, true, strings.HasPrefix(src.name, PARALLEL_UPLOAD_PREFIX+"parallel/large.bin/"))
+			require.Equal(t, true, src.generation > 0)
+		}
+	}
+	final := fake.composes[3]
+	require.Equal(t, "parallel/large.bin", final.name)
+	require.Equal(t, 3, len(final.sources))
+	require.Equal(t, "", final.query.Get("ifGenerationMatch"))
+	require.Equal(t, 0, len(fake.names("test-bucket", PARALLEL_UPLOAD_PREFIX)))
+
+	// failed part fails upload & uploaded parts are deleted
+	fake.uploads = nil
+	fake.composes = nil
+	fake.failUpload = func(name string) bool {
+		return strings.HasSuffix(name, "/part-00005")
+	}
+	failCfr, err := NewCloudFileRequest("test-bucket", "failed.bin", "parallel", 0, WithPartSize(OneKB), WithConcurrency(1))
+	require.NoError(t, err)
+	_, err = client.UploadFileParallel(ctx, bytes.NewReader(data), int64(len(data)), failCfr)
+	require.ErrorIs(t, err, ErrTransient)
+	require.Equal(t, 6, len(fake.uploads))
+	require.Equal(t, 0, len(fake.composes))
+	require.Nil(t, fake.object("test-bucket", "parallel/failed.bin"))
+	require.Equal(t, 0, len(fake.names("test-bucket", PARALLEL_UPLOAD_PREFIX)))
+	fake.failUpload = nil
+
+	// request preconditions are final compose preconditions
+	fake.uploads = nil
+	fake.composes = nil
+	small := data[:3*1024]
+	absentCfr, err := NewCloudFileRequest("test-bucket", "absent.bin", "parallel", 0, WithPartSize(OneKB), WithIfAbsent(), WithTempPrefix("tmp/"))
+	require.NoError(t, err)
+	n, err = client.UploadFileParallel(ctx, bytes.NewReader(small), int64(len(small)), absentCfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(small)), n)
+	require.Equal(t, 1, len(fake.composes))
+	require.Equal(t, "0", fake.composes[0].query.Get("ifGenerationMatch"))
+	for _, name := range fake.uploads {
+		require.Equal(t, true, strings.HasPrefix(name, "tmp/parallel/absent.bin/"))
+	}
+	require.Equal(t, 0, len(fake.names("test-bucket", "tmp/")))
+
+	// object created while parts upload fails final compose
+	fake.afterUpload = func(name string) {
+		if _, ok := fake.objects["test-bucket/parallel/racy.bin"]; !ok {
+			fake.put("test-bucket", "parallel/racy.bin", []byte("concurrent"))
+		}
+	}
+	racyCfr, err := NewCloudFileRequest("test-bucket", "racy.bin", "parallel", 0, WithPartSize(OneKB), WithIfAbsent())
+	require.NoError(t, err)
+	_, err = client.UploadFileParallel(ctx, bytes.NewReader(small), int64(len(small)), racyCfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+	require.Equal(t, []byte("concurrent"), fake.object("test-bucket", "parallel/racy.bin"))
+	require.Equal(t, 0, len(fake.names("test-bucket", PARALLEL_UPLOAD_PREFIX)))
+	fake.afterUpload = nil
+}
+
+func TestUploadFileParallelGCP(t *testing.T) {
+	testCfg := getTestConfig()
+	client, teardown := setupCloudTest(t, testCfg)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// more than MAX_COMPOSE_SOURCES parts are composed through intermediate composites
+	data := bytes.Repeat([]byte("0123456789abcdef"), 70*64+10)
+	cfr, err := NewCloudFileRequest(testCfg.bucket, "parallel.bin", testCfg.dir, 0, WithPartSize(OneKB), WithConcurrency(4))
+	require.NoError(t, err)
+
+	uploader, ok := client.(ParallelUploader)
+	require.Equal(t, true, ok)
+	n, err := uploader.UploadFileParallel(ctx, bytes.NewReader(data), int64(len(data)), cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	var buf bytes.Buffer
+	_, err = client.DownloadFile(ctx, &buf, cfr)
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+
+	err = client.DeleteObject(ctx, cfr)
+	require.NoError(t, err)
+}
+
+func TestCRC32Combine(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	for _, split := range []int{0, 1, 15, 4096, len(data) - 1, len(data)} {
+		crc1 := crc32.Checksum(data[:split], crc32cTable)
+		crc2 := crc32.Checksum(data[split:], crc32cTable)
+		require.Equal(t, crc32.Checksum(data, crc32cTable), crc32Combine(crc1, crc2, int64(len(data)-split)))
+	}
+}
+
+func TestDownloadFileParallel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := newFakeGCS()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := newParallelTestClient(t, srv.URL)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10*64+10)
+	fake.mu.Lock()
+	obj := fake.put("test-bucket", "parallel/download.bin", data)
+	fake.mu.Unlock()
+	cfr, err := NewCloudFileRequest("test-bucket", "download.bin", "parallel", 0, WithPartSize(OneKB), WithConcurrency(4))
+	require.NoError(t, err)
+
+	download := func(cfr CloudFileRequest) (int64, []byte, error) {
+		file, err := os.Create(filepath.Join(t.TempDir(), "download.bin"))
+		require.NoError(t, err)
+		defer func() {
+			err := file.Close()
+			require.NoError(t, err)
+		}()
+		n, err := client.DownloadFileParallel(ctx, file, cfr)
+		downloaded, rErr := os.ReadFile(file.Name())
+		require.NoError(t, rErr)
+		return n, downloaded, err
+	}
+
+	// all ranges are read from generation current when download starts
+	n, downloaded, err := download(cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, downloaded)
+	require.Equal(t, 11, len(fake.reads))
+	for _, gen := range fake.reads {
+		require.Equal(t, strconv.FormatInt(obj.generation, 10), gen)
+	}
+
+	// corrupted range fails checksum verification
+	fake.onRead = func(name string, start int64, data []byte) {
+		if start == 2*1024 {
+			data[0] ^= 0xff
+		}
+	}
+	_, _, err = download(cfr)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// object replaced while ranges download fails remaining reads
+	fake.reads = nil
+	fake.onRead = func(name string, start int64, data []byte) {
+		if start == 0 {
+			fake.put("test-bucket", name, []byte("replaced"))
+		}
+	}
+	seqCfr, err := NewCloudFileRequest("test-bucket", "download.bin", "parallel", 0, WithPartSize(OneKB), WithConcurrency(1))
+	require.NoError(t, err)
+	_, _, err = download(seqCfr)
+	require.ErrorIs(t, err, ErrStaleDownload)
+	require.Equal(t, 2, len(fake.reads))
+	require.Equal(t, fake.reads[0], fake.reads[1])
+	fake.onRead = nil
+
+	// request generation is checked before ranges download
+	fake.reads = nil
+	pinnedCfr, err := NewCloudFileRequest("test-bucket", "download.bin", "parallel", 0, WithPartSize(OneKB), WithGeneration(obj.generation))
+	require.NoError(t, err)
+	_, _, err = download(pinnedCfr)
+	require.ErrorIs(t, err, ErrStaleDownload)
+	require.Equal(t, 0, len(fake.reads))
+}
+
+func TestDownloadFileParallelGCP(t *testing.T) {
+	testCfg := getTestConfig()
+	client, teardown := setupCloudTest(t, testCfg)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10*64+10)
+	cfr, err := NewCloudFileRequest(testCfg.bucket, "parallel-download.bin", testCfg.dir, 0, WithPartSize(OneKB), WithConcurrency(4))
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "parallel-download.bin"))
+	require.NoError(t, err)
+	defer func() {
+		err := file.Close()
+		require.NoError(t, err)
+	}()
+
+	downloader, ok := client.(ParallelDownloader)
+	require.Equal(t, true, ok)
+	n, err := downloader.DownloadFileParallel(ctx, file, cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	downloaded, err := os.ReadFile(file.Name())
+	require.NoError(t, err)
+	require.Equal(t, data, downloaded)
+
+	err = client.DeleteObject(ctx, cfr)
+	require.NoError(t, err)
+}
@@ -0,0 +1,270 @@
+package cloudstorage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comfforts/errors"
+	"github.com/comfforts/logger"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// accountKey identifies storage account credentials & client settings, clients are shared by accounts with equal keys
+type accountKey struct {
+	storageURL  string
+	endpoint    string
+	anonymous   bool
+	credsPath   string
+	credsHash   string
+	tokenSource oauth2.TokenSource
+	impersonate string
+	transfer    time.Duration
+	metadata    time.Duration
+	retry       retryKey
+	chunkSize   BufferSize
+	bufferSize  BufferSize
+}
+
+// retryKey is comparable retry policy, with defaults applied & retryable kinds joined
+type retryKey struct {
+	maxAttempts        int
+	initialBackoff     time.Duration
+	maxBackoff         time.Duration
+	multiplier         float64
+	jitter             float64
+	retryableKinds     string
+	retryNonIdempotent bool
+}
+
+// newRetryKey returns retry key for given retry policy, default policy when nil,
+// policies retrying alike have equal keys
+func newRetryKey(policy *RetryPolicy) retryKey {
+	rp := DefaultRetryPolicy()
+	if policy != nil {
+		rp = policy.withDefaults()
+	}
+	kinds := make([]string, len(rp.RetryableKinds))
+	for i, kind := range rp.RetryableKinds {
+		kinds[i] = fmt.Sprintf("%T:%v", kind, kind)
+	}
+	return retryKey{
+		maxAttempts:        rp.MaxAttempts,
+		initialBackoff:     rp.InitialBackoff,
+		maxBackoff:         rp.MaxBackoff,
+		multiplier:         rp.Multiplier,
+		jitter:             rp.Jitter,
+		retryableKinds:     strings.Join(kinds, ","),
+		retryNonIdempotent: rp.RetryNonIdempotent,
+	}
+}
+
+// newAccountKey returns account key for client config, token sources are compared by identity
+func newAccountKey(cfg CloudStorageClientConfig) (accountKey, error) {
+	key := accountKey{
+		storageURL:  cfg.StorageURL,
+		endpoint:    cfg.Endpoint,
+		anonymous:   cfg.Anonymous,
+		credsPath:   cfg.CredsPath,
+		tokenSource: cfg.TokenSource,
+		impersonate: strings.Join(append([]string{cfg.ImpersonateServiceAccount}, cfg.ImpersonateDelegates...), ","),
+		transfer:    cfg.TransferTimeout,
+		metadata:    cfg.MetadataTimeout,
+		retry:       newRetryKey(cfg.Retry),
+		chunkSize:   cfg.ChunkSize,
+		bufferSize:  cfg.BufferSize,
+	}
+	if len(cfg.CredsJSON) > 0 {
+		sum := sha256.Sum256(cfg.CredsJSON)
+		key.credsHash = hex.EncodeToString(sum[:])
+	}
+	// token source is part of map key, must be comparable
+	if cfg.TokenSource != nil && !reflect.TypeOf(cfg.TokenSource).Comparable() {
+		return accountKey{}, ErrInvalidAccount
+	}
+	return key, nil
+}
+
+// clientBuild is an account client being created, done is closed once client or error is set
+type clientBuild struct {
+	done   chan struct{}
+	client CloudStorage
+	err    error
+}
+
+// clientPool lazily creates & caches cloud storage clients per account credentials,
+// & routes requests to clients by bucket
+type clientPool struct {
+	mu             sync.Mutex
+	accounts       map[accountKey]CloudStorageClientConfig
+	clients        map[accountKey]CloudStorage
+	building       map[accountKey]*clientBuild
+	buckets        map[string]accountKey
+	defaultAccount *accountKey
+	closed         bool
+	logger         logger.AppLogger
+}
+
+// NewClientPool takes logger, returns empty client pool
+func NewClientPool(logger logger.AppLogger) (*clientPool, error) {
+	if logger == nil {
+		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+	return &clientPool{
+		accounts: map[accountKey]CloudStorageClientConfig{},
+		clients:  map[accountKey]CloudStorage{},
+		building: map[accountKey]*clientBuild{},
+		buckets:  map[string]accountKey{},
+		logger:   logger,
+	}, nil
+}
+
+// AddAccount adds account with given client config, routes given buckets to it,
+// remapping buckets routed to other accounts. Client is created on first use
+func (cp *clientPool) AddAccount(cfg CloudStorageClientConfig, buckets ...string) error {
+	for _, bucket := range buckets {
+		if bucket == "" {
+			return ErrBucketNameMissing
+		}
+	}
+	key, err := cp.addAccount(cfg)
+	if err != nil {
+		return err
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, bucket := range buckets {
+		cp.buckets[bucket] = key
+	}
+	return nil
+}
+
+// SetDefaultAccount adds account with given client config, for buckets not routed to other accounts
+func (cp *clientPool) SetDefaultAccount(cfg CloudStorageClientConfig) error {
+	key, err := cp.addAccount(cfg)
+	if err != nil {
+		return err
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.defaultAccount = &key
+	return nil
+}
+
+func (cp *clientPool) addAccount(cfg CloudStorageClientConfig) (accountKey, error) {
+	key, err := newAccountKey(cfg)
+	if err != nil {
+		cp.logger.Error(ERROR_INVALID_ACCOUNT, zap.String("storageURL", cfg.StorageURL))
+		return accountKey{}, err
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed {
+		return accountKey{}, ErrPoolClosed
+	}
+	if _, ok := cp.accounts[key]; !ok {
+		cp.accounts[key] = cfg
+	}
+	return key, nil
+}
+
+// Client returns client for given bucket account, creates account client on first use.
+// Clients are created without holding pool lock, concurrent first uses of an account wait for one creation
+func (cp *clientPool) Client(bucket string) (CloudStorage, error) {
+	if bucket == "" {
+		return nil, ErrBucketNameMissing
+	}
+
+	cp.mu.Lock()
+	if cp.closed {
+		cp.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+
+	key, ok := cp.buckets[bucket]
+	if !ok {
+		if cp.defaultAccount == nil {
+			cp.mu.Unlock()
+			cp.logger.Error(ERROR_NO_ACCOUNT, zap.String("bucket", bucket))
+			return nil, ErrNoAccount
+		}
+		key = *cp.defaultAccount
+	}
+
+	if client, ok := cp.clients[key]; ok {
+		cp.mu.Unlock()
+		return client, nil
+	}
+	if build, ok := cp.building[key]; ok {
+		cp.mu.Unlock()
+		<-build.done
+		return build.client, build.err
+	}
+	build := &clientBuild{done: make(chan struct{})}
+	cp.building[key] = build
+	cfg := cp.accounts[key]
+	cp.mu.Unlock()
+
+	client, err := NewCloudStorage(cfg, cp.logger)
+
+	// publish client, unless pool was closed meanwhile. Failed creations aren't cached
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	delete(cp.building, key)
+	if err == nil && cp.closed {
+		if cErr := client.Close(); cErr != nil {
+			cp.logger.Error("error closing storage client", zap.Error(cErr), zap.String("storageURL", key.storageURL))
+		}
+		client, err = nil, ErrPoolClosed
+	}
+	if err == nil {
+		cp.clients[key] = client
+		cp.logger.Debug("created storage client", zap.String("bucket", bucket), zap.Int("clients", len(cp.clients)))
+	} else if err != ErrPoolClosed {
+		cp.logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(err), zap.String("bucket", bucket))
+	}
+	build.client, build.err = client, err
+	close(build.done)
+	return client, err
+}
+
+// ClientFor returns client for given request bucket
+func (cp *clientPool) ClientFor(cfr CloudFileRequest) (CloudStorage, error) {
+	return cp.Client(cfr.bucket)
+}
+
+// Close closes all created clients, returns error if any client failed to close,
+// pool can't be used after close
+func (cp *clientPool) Close() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed {
+		return nil
+	}
+	cp.closed = true
+
+	failed := 0
+	var closeErr error
+	for key, client := range cp.clients {
+		if err := client.Close(); err != nil {
+			cp.logger.Error("error closing storage client", zap.Error(err), zap.String("storageURL", key.storageURL))
+			failed++
+			if closeErr == nil {
+				closeErr = err
+			}
+		}
+	}
+	cp.clients = map[accountKey]CloudStorage{}
+	if closeErr != nil {
+		return wrapStorageError(closeErr, "error closing %d storage clients", failed)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPool(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+	pool, err := NewClientPool(appLogger)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tenantA := CloudStorageClientConfig{StorageURL: "mem://", CredsPath: "creds/tenant-a.json"}
+	tenantB := CloudStorageClientConfig{StorageURL: "mem://", CredsJSON: []byte(`{"client_email": "b@tenant-b"}`)}
+	require.NoError(t, pool.AddAccount(tenantA, "bucket-a", "bucket-a2"))
+	require.NoError(t, pool.AddAccount(tenantB, "bucket-b"))
+	require.ErrorIs(t, pool.AddAccount(tenantB, ""), ErrBucketNameMissing)
+
+	_, err = pool.Client("bucket-c")
+	require.ErrorIs(t, err, ErrNoAccount)
+
+	// buckets of an account share a client
+	clientA, err := pool.Client("bucket-a")
+	require.NoError(t, err)
+	clientA2, err := pool.Client("bucket-a2")
+	require.NoError(t, err)
+	require.Equal(t, true, clientA == clientA2)
+
+	cfr, err := NewCloudFileRequest("bucket-b", "data.json", "tenant", 0)
+	require.NoError(t, err)
+	clientB, err := pool.ClientFor(cfr)
+	require.NoError(t, err)
+	require.Equal(t, false, clientA == clientB)
+
+	_, err = clientB.UploadFile(ctx, bytes.NewReader([]byte(`{"tenant": "b"}`)), cfr)
+	require.NoError(t, err)
+	_, err = clientA.StatObject(ctx, cfr)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+
+	// unmapped buckets go to default account, equal credentials share client
+	require.NoError(t, pool.SetDefaultAccount(CloudStorageClientConfig{StorageURL: "mem://", CredsJSON: []byte(`{"client_email": "b@tenant-b"}`)}))
+	clientC, err := pool.Client("bucket-c")
+	require.NoError(t, err)
+	require.Equal(t, true, clientB == clientC)
+
+	// retry policies are compared by value
+	retryA := CloudStorageClientConfig{StorageURL: "mem://", Retry: &RetryPolicy{MaxAttempts: 2, RetryableKinds: []error{ErrTransient}}}
+	retryA2 := CloudStorageClientConfig{StorageURL: "mem://", Retry: &RetryPolicy{MaxAttempts: 2, RetryableKinds: []error{ErrTransient}}}
+	retryB := CloudStorageClientConfig{StorageURL: "mem://", Retry: &RetryPolicy{MaxAttempts: 2, RetryableKinds: []error{ErrRateLimited}}}
+	require.NoError(t, pool.AddAccount(retryA, "retry-a"))
+	require.NoError(t, pool.AddAccount(retryA2, "retry-a2"))
+	require.NoError(t, pool.AddAccount(retryB, "retry-b"))
+	clientRetryA, err := pool.Client("retry-a")
+	require.NoError(t, err)
+	clientRetryA2, err := pool.Client("retry-a2")
+	require.NoError(t, err)
+	require.Equal(t, true, clientRetryA == clientRetryA2)
+	clientRetryB, err := pool.Client("retry-b")
+	require.NoError(t, err)
+	require.Equal(t, false, clientRetryA == clientRetryB)
+
+	require.NoError(t, pool.Close())
+	_, err = pool.Client("bucket-a")
+	require.ErrorIs(t, err, ErrPoolClosed)
+	require.ErrorIs(t, pool.AddAccount(tenantA, "bucket-d"), ErrPoolClosed)
+}
+
+func TestClientPoolConcurrentCreate(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+	pool, err := NewClientPool(appLogger)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, pool.Close())
+	}()
+
+	// slow client creation blocks until released
+	var created int32
+	started, release := make(chan struct{}), make(chan struct{})
+	RegisterBackend("pool-test", func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		if atomic.AddInt32(&created, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return NewMemoryStorageClient(logger)
+	})
+
+	require.NoError(t, pool.AddAccount(CloudStorageClientConfig{StorageURL: "pool-test://"}, "bucket-slow"))
+	require.NoError(t, pool.AddAccount(CloudStorageClientConfig{StorageURL: "mem://"}, "bucket-fast"))
+
+	var wg sync.WaitGroup
+	clients := make([]CloudStorage, 8)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := pool.Client("bucket-slow")
+			require.NoError(t, err)
+			clients[i] = client
+		}(i)
+	}
+
+	// other accounts aren't blocked by a client being created
+	<-started
+	_, err = pool.Client("bucket-fast")
+	require.NoError(t, err)
+
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&created))
+	for _, client := range clients {
+		require.Equal(t, true, client == clients[0])
+	}
+}
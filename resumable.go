@@ -0,0 +1,551 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/comfforts/errors"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	// RESUMABLE_CHUNK_ALIGN is resumable upload chunk size unit, all chunks but the last are its multiples
+	RESUMABLE_CHUNK_ALIGN = 256 * 1024
+	// DEFAULT_RESUMABLE_CHUNK_SIZE is size of resumable upload chunks, committed & checkpointed one at a time
+	DEFAULT_RESUMABLE_CHUNK_SIZE = int64(SixteenMB)
+
+	gcsUploadEndpoint      = "https://storage.googleapis.com/upload/storage/v1/"
+	statusResumeIncomplete = 308
+	sniffLen               = 512
+)
+
+// UploadCheckpoint is progress of a resumable upload, saved after each committed chunk
+type UploadCheckpoint struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	// SessionURI is resumable upload session, it authorizes uploads to the object & should be kept private
+	SessionURI string `json:"session_uri"`
+	// Size is total upload size, checkpoints of a different size aren't resumed
+	Size int64 `json:"size"`
+	// Version identifies uploaded source content, request modTime if set, else source file modification time,
+	// else content CRC32C. Checkpoints of a different version aren't resumed
+	Version string `json:"version"`
+	// Offset is number of bytes committed by storage
+	Offset  int64     `json:"offset"`
+	Updated time.Time `json:"updated"`
+}
+
+// CheckpointStore persists resumable upload checkpoints by upload key, so uploads resume after restarts
+type CheckpointStore interface {
+	// LoadCheckpoint returns checkpoint saved for key, nil if there is none
+	LoadCheckpoint(ctx context.Context, key string) (*UploadCheckpoint, error)
+	// SaveCheckpoint saves checkpoint for key, replacing saved one
+	SaveCheckpoint(ctx context.Context, key string, cp UploadCheckpoint) error
+	// DeleteCheckpoint deletes checkpoint saved for key, if any
+	DeleteCheckpoint(ctx context.Context, key string) error
+}
+
+// ResumableUploader is implemented by storage clients supporting uploads resumable across restarts
+type ResumableUploader interface {
+	// ResumableUpload uploads file to given cloud bucket & filepath in chunks, saving upload session & committed offset
+	// to given store after each chunk. Upload of same request resumes at checkpoint offset, checkpoint is deleted once done
+	ResumableUpload(ctx context.Context, file io.ReadSeeker, cfr CloudFileRequest, store CheckpointStore) (int64, error)
+}
+
+// fileCheckpointStore saves checkpoints as JSON files in a directory, one per upload key
+type fileCheckpointStore struct {
+	dir string
+}
+
+// NewFileCheckpointStore takes directory, created if missing, returns file checkpoint store
+func NewFileCheckpointStore(dir string) (*fileCheckpointStore, error) {
+	if dir == "" {
+		return nil, ErrFilePathMissing
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, wrapStorageError(err, "error creating checkpoint directory %s", dir)
+	}
+	return &fileCheckpointStore{dir: dir}, nil
+}
+
+func (fcs *fileCheckpointStore) LoadCheckpoint(ctx context.Context, key string) (*UploadCheckpoint, error) {
+	data, err := os.ReadFile(fcs.checkpointPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, wrapStorageError(err, ERROR_LOADING_CHECKPOINT)
+	}
+	cp := UploadCheckpoint{}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, wrapStorageError(err, ERROR_LOADING_CHECKPOINT)
+	}
+	return &cp, nil
+}
+
+// SaveCheckpoint replaces checkpoint file atomically, a crash leaves previous checkpoint in place
+func (fcs *fileCheckpointStore) SaveCheckpoint(ctx context.Context, key string, cp UploadCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	tmp, err := os.CreateTemp(fcs.dir, ".checkpoint-*")
+	if err != nil {
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	if err := tmp.Close(); err != nil {
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	if err := os.Rename(tmp.Name(), fcs.checkpointPath(key)); err != nil {
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	return nil
+}
+
+func (fcs *fileCheckpointStore) DeleteCheckpoint(ctx context.Context, key string) error {
+	if err := os.Remove(fcs.checkpointPath(key)); err != nil && !os.IsNotExist(err) {
+		return wrapStorageError(err, "error deleting upload checkpoint")
+	}
+	return nil
+}
+
+// checkpointPath returns checkpoint file path for key, keys are hashed to be valid file names
+func (fcs *fileCheckpointStore) checkpointPath(key string) string {
+	return filepath.Join(fcs.dir, sha256Hex([]byte(key))+".json")
+}
+
+// checkpointKey returns checkpoint store key of upload to given bucket & object
+func checkpointKey(bucket, name string) string {
+	return fmt.Sprintf("gs://%s/%s", bucket, name)
+}
+
+// gcsObjectResource is JSON API object resource of a completed upload
+type gcsObjectResource struct {
+	Generation int64 `json:"generation,string"`
+}
+
+// gcsUploadMetadata is JSON API object metadata of a resumable upload session
+type gcsUploadMetadata struct {
+	Name         string            `json:"name"`
+	ContentType  string            `json:"contentType,omitempty"`
+	StorageClass string            `json:"storageClass,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// ResumableUpload uploads file through a GCS resumable upload session, each chunk request is bounded by transfer timeout
+// & retried, resuming at offset committed by storage. Preconditions are checked when upload session starts
+func (cs *cloudStorageClient) ResumableUpload(ctx context.Context, file io.ReadSeeker, cfr CloudFileRequest, store CheckpointStore) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	if store == nil {
+		return 0, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+	fPath := cfr.objectName()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		cs.logger.Error("error seeking file", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "error seeking file %s", fPath)
+	}
+
+	key := checkpointKey(cfr.bucket, fPath)
+	cp, err := store.LoadCheckpoint(ctx, key)
+	if err != nil {
+		cs.logger.Error(ERROR_LOADING_CHECKPOINT, zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, ERROR_LOADING_CHECKPOINT)
+	}
+	version, err := sourceVersion(cfr, file)
+	if err != nil {
+		cs.logger.Error("error reading file", zap.Error(err), zap.String("filepath", fPath))
+		return 0, wrapStorageError(err, "error reading file %s", fPath)
+	}
+	if cp != nil && (cp.Bucket != cfr.bucket || cp.Name != fPath || cp.Size != size || cp.Version != version) {
+		cs.logger.Info(
+			"discarding upload checkpoint of a different file",
+			zap.String("filepath", fPath),
+			zap.Int64("size", size),
+			zap.Int64("checkpointSize", cp.Size),
+			zap.String("version", version),
+			zap.String("checkpointVersion", cp.Version),
+		)
+		cp = nil
+	}
+
+	// resume at offset committed by storage, which may be past saved offset
+	if cp != nil {
+		var offset int64
+		var done bool
+		err := cs.retry.retry(ctx, cs.logger, "upload status", true, func(attempt int) error {
+			var err error
+			offset, done, err = cs.uploadChunk(ctx, cfr, cp.SessionURI, file, nil, offset, size)
+			return err
+		})
+		switch {
+		case isKind(err, ErrUploadSessionExpired):
+			cs.logger.Info("upload session expired, restarting upload", zap.String("filepath", fPath), zap.Int64("offset", cp.Offset))
+			cp = nil
+		case err != nil:
+			cs.logger.Error("error resuming upload", zap.Error(err), zap.String("filepath", fPath))
+			return 0, err
+		case done:
+			cs.deleteCheckpoint(ctx, store, key, fPath)
+			return size, nil
+		default:
+			cs.logger.Debug("resuming upload", zap.String("filepath", fPath), zap.Int64("offset", offset), zap.Int64("size", size))
+			cp.Offset = offset
+		}
+	}
+
+	if cp == nil {
+		sessionURI, err := cs.startUploadSession(ctx, cfr, file, size)
+		if err != nil {
+			return 0, err
+		}
+		cp = &UploadCheckpoint{
+			Bucket:     cfr.bucket,
+			Name:       fPath,
+			SessionURI: sessionURI,
+			Size:       size,
+			Version:    version,
+		}
+		if err := cs.saveCheckpoint(ctx, store, key, cp); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := make([]byte, cs.resumableChunkSize(cfr))
+	for {
+		offset := cp.Offset
+		var done bool
+		err := cs.retry.retry(ctx, cs.logger, "upload chunk", true, func(attempt int) error {
+			// a failed chunk may be partly committed, ask storage where to resume
+			if attempt > 1 {
+				var err error
+				if offset, done, err = cs.uploadChunk(ctx, cfr, cp.SessionURI, file, nil, offset, size); err != nil || done {
+					return err
+				}
+			}
+			var err error
+			offset, done, err = cs.uploadChunk(ctx, cfr, cp.SessionURI, file, buf, offset, size)
+			return err
+		})
+		if err != nil {
+			if isKind(err, ErrUploadSessionExpired) || isKind(err, ErrStaleUpload) {
+				cs.deleteCheckpoint(ctx, store, key, fPath)
+			}
+			cs.logger.Error("error uploading file chunk", zap.Error(err), zap.String("filepath", fPath), zap.Int64("offset", cp.Offset))
+			return 0, err
+		}
+		if done {
+			cs.deleteCheckpoint(ctx, store, key, fPath)
+			return size, nil
+		}
+
+		cp.Offset = offset
+		if err := cs.saveCheckpoint(ctx, store, key, cp); err != nil {
+			return 0, err
+		}
+		cs.logger.Debug("upload chunk committed", zap.String("filepath", fPath), zap.Int64("offset", offset), zap.Int64("size", size))
+	}
+}
+
+// startUploadSession starts resumable upload session guarded by request preconditions, returns session URI
+func (cs *cloudStorageClient) startUploadSession(ctx context.Context, cfr CloudFileRequest, file io.ReadSeeker, size int64) (string, error) {
+	fPath := cfr.objectName()
+	hc, err := cs.httpClient()
+	if err != nil {
+		return "", err
+	}
+
+	var conds *storage.Conditions
+	if cfr.isConditional() {
+		var attrs *storage.ObjectAttrs
+		err := cs.retry.retry(ctx, cs.logger, "stat", true, func(attempt int) error {
+			sCtx, cancel := cfr.withTimeout(ctx, cs.config.MetadataTimeout)
+			defer cancel()
+			var err error
+			attrs, err = cs.object(cfr.bucket, fPath).Attrs(sCtx)
+			return err
+		})
+		if err != nil && !isKind(err, storage.ErrObjectNotExist) {
+			cs.logger.Error("cloud file inaccessible", zap.Error(err), zap.String("filepath", fPath))
+			return "", wrapStorageError(err, "cloud file inaccessible %s", fPath)
+		}
+		if conds, err = uploadConditions(cfr, attrs); err != nil {
+			cs.logger.Error(ERROR_STALE_UPLOAD, zap.String("filepath", fPath), zap.Int64("modTime", cfr.modTime), zap.Int64("generation", cfr.generation))
+			return "", err
+		}
+	}
+
+	attrs := storage.ObjectAttrs{}
+	cfr.applyAttrs(&attrs)
+	if attrs.ContentType == "" {
+		if attrs.ContentType, err = sniffContentType(file); err != nil {
+			cs.logger.Error("error reading file", zap.Error(err), zap.String("filepath", fPath))
+			return "", wrapStorageError(err, "error reading file %s", fPath)
+		}
+	}
+	body, err := json.Marshal(gcsUploadMetadata{
+		Name:         fPath,
+		ContentType:  attrs.ContentType,
+		StorageClass: attrs.StorageClass,
+		Metadata:     attrs.Metadata,
+	})
+	if err != nil {
+		return "", wrapStorageError(err, ERROR_UPLOAD_SESSION)
+	}
+
+	query := url.Values{}
+	query.Set("uploadType", "resumable")
+	query.Set("name", fPath)
+	if conds != nil {
+		if conds.DoesNotExist {
+			query.Set("ifGenerationMatch", "0")
+		} else if conds.GenerationMatch > 0 {
+			query.Set("ifGenerationMatch", strconv.FormatInt(conds.GenerationMatch, 10))
+		}
+		if conds.MetagenerationMatch > 0 {
+			query.Set("ifMetagenerationMatch", strconv.FormatInt(conds.MetagenerationMatch, 10))
+		}
+	}
+	sessionURL := fmt.Sprintf("%sb/%s/o?%s", cs.uploadURL, url.PathEscape(cfr.bucket), query.Encode())
+
+	// starting another session on retry is harmless, unused sessions expire
+	var sessionURI string
+	err = cs.retry.retry(ctx, cs.logger, "start upload", true, func(attempt int) error {
+		rCtx, cancel := cfr.withTimeout(ctx, cs.config.MetadataTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(rCtx, http.MethodPost, sessionURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", attrs.ContentType)
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+		resp, err := hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		sessionURI = resp.Header.Get("Location")
+		if sessionURI == "" {
+			return errors.NewAppError("upload session location missing")
+		}
+		return nil
+	})
+	if err != nil {
+		if isPreconditionFailed(err) {
+			cs.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("filepath", fPath))
+			return "", kindError(ErrStaleUpload, err)
+		}
+		cs.logger.Error(ERROR_UPLOAD_SESSION, zap.Error(err), zap.String("filepath", fPath))
+		return "", wrapStorageError(err, ERROR_UPLOAD_SESSION)
+	}
+	cs.logger.Debug("upload session started", zap.String("filepath", fPath), zap.Int64("size", size))
+	return sessionURI, nil
+}
+
+// uploadChunk uploads chunk of file at given offset, up to buffer size, to upload session.
+// With nil buffer, only queries upload status. Returns offset committed by storage & whether upload is done
+func (cs *cloudStorageClient) uploadChunk(ctx context.Context, cfr CloudFileRequest, sessionURI string, file io.ReadSeeker, buf []byte, offset, size int64) (int64, bool, error) {
+	fPath := cfr.objectName()
+	hc, err := cs.httpClient()
+	if err != nil {
+		return 0, false, err
+	}
+
+	n := int64(len(buf))
+	if n > size-offset {
+		n = size - offset
+	}
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if n > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, false, wrapStorageError(err, "error seeking file %s", fPath)
+		}
+		if _, err := io.ReadFull(file, buf[:n]); err != nil {
+			return 0, false, wrapStorageError(err, "error reading file %s", fPath)
+		}
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)
+	}
+
+	rCtx, cancel := cfr.withTimeout(ctx, cs.config.TransferTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(rCtx, http.MethodPut, sessionURI, bytes.NewReader(buf[:n]))
+	if err != nil {
+		return 0, false, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, false, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case statusResumeIncomplete:
+		return committedOffset(resp.Header.Get("Range")), false, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, false, kindError(ErrUploadSessionExpired, googleapi.CheckResponse(resp))
+	}
+	if err := googleapi.CheckResponse(resp); err != nil {
+		if isPreconditionFailed(err) {
+			cs.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("filepath", fPath))
+			return 0, false, kindError(ErrStaleUpload, err)
+		}
+		return 0, false, wrapStorageError(err, "error uploading file %s", fPath)
+	}
+
+	obj := gcsObjectResource{}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		cs.logger.Debug("error decoding uploaded object", zap.Error(err), zap.String("filepath", fPath))
+	}
+	cs.logger.Debug("cloud file created/updated", zap.String("filepath", fPath), zap.Int64("generation", obj.Generation))
+	return size, true, nil
+}
+
+// resumableChunkSize returns request or client chunk size rounded up to a multiple of RESUMABLE_CHUNK_ALIGN,
+// DEFAULT_RESUMABLE_CHUNK_SIZE when unset or SingleShot
+func (cs *cloudStorageClient) resumableChunkSize(cfr CloudFileRequest) int64 {
+	size := int64(cs.chunkSize(cfr))
+	if size <= 0 {
+		return DEFAULT_RESUMABLE_CHUNK_SIZE
+	}
+	return (size + RESUMABLE_CHUNK_ALIGN - 1) / RESUMABLE_CHUNK_ALIGN * RESUMABLE_CHUNK_ALIGN
+}
+
+// committedOffset takes resumable upload Range header, e.g. bytes=0-1023, returns number of committed bytes
+func committedOffset(rangeHeader string) int64 {
+	i := strings.LastIndex(rangeHeader, "-")
+	if i < 0 {
+		return 0
+	}
+	end, err := strconv.ParseInt(rangeHeader[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return end + 1
+}
+
+// sourceVersion returns version of upload source, so changed files of same size aren't resumed. Version is
+// request modTime if set, else modification time of sources with Stat, e.g. *os.File, else CRC32C of content.
+// Content CRC32C costs a full extra read of the source on each start & resume, set modTime for large readers
+func sourceVersion(cfr CloudFileRequest, file io.ReadSeeker) (string, error) {
+	if cfr.modTime > 0 {
+		return fmt.Sprintf("modtime:%d", cfr.modTime), nil
+	}
+	if f, ok := file.(interface{ Stat() (os.FileInfo, error) }); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("mtime:%d", fi.ModTime().UnixNano()), nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("crc32c:%08x", hash.Sum32()), nil
+}
+
+// sniffContentType detects content type of file start, like storage writer does for uploads without one
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// saveCheckpoint saves upload checkpoint, stamped with save time
+func (cs *cloudStorageClient) saveCheckpoint(ctx context.Context, store CheckpointStore, key string, cp *UploadCheckpoint) error {
+	cp.Updated = time.Now()
+	if err := store.SaveCheckpoint(ctx, key, *cp); err != nil {
+		cs.logger.Error(ERROR_SAVING_CHECKPOINT, zap.Error(err), zap.String("filepath", cp.Name), zap.Int64("offset", cp.Offset))
+		return wrapStorageError(err, ERROR_SAVING_CHECKPOINT)
+	}
+	return nil
+}
+
+// deleteCheckpoint deletes checkpoint of a finished or failed upload, failures are logged only
+func (cs *cloudStorageClient) deleteCheckpoint(ctx context.Context, store CheckpointStore, key, fPath string) {
+	if err := store.DeleteCheckpoint(ctx, key); err != nil {
+		cs.logger.Error("error deleting upload checkpoint", zap.Error(err), zap.String("filepath", fPath))
+	}
+}
+
+// httpClient returns client authorized like storage client, for JSON API calls storage library doesn't expose,
+// created on first use
+func (cs *cloudStorageClient) httpClient() (*http.Client, error) {
+	cs.hcOnce.Do(func() {
+		opts := append([]option.ClientOption{option.WithScopes(storage.ScopeFullControl)}, cs.opts...)
+		cs.hc, _, cs.hcErr = htransport.NewClient(context.Background(), opts...)
+		if cs.hcErr != nil {
+			cs.logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.Error(cs.hcErr))
+			cs.hcErr = wrapStorageError(cs.hcErr, ERROR_CREATING_STORAGE_CLIENT)
+		}
+	})
+	return cs.hc, cs.hcErr
+}
+
+// gcsUploadURL returns JSON API upload endpoint for config endpoint override or emulator host
+func gcsUploadURL(cfg CloudStorageClientConfig) (string, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("STORAGE_EMULATOR_HOST")
+	}
+	if endpoint == "" {
+		return gcsUploadEndpoint, nil
+	}
+	endpoint, err := gcsEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", ErrInvalidStorageURL
+	}
+	u.Path = "/upload" + u.Path
+	return u.String(), nil
+}
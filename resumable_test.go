@@ -0,0 +1,269 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGCSUpload is a GCS JSON API resumable upload endpoint, failing chunk uploads at given offsets
+type fakeGCSUpload struct {
+	mu       sync.Mutex
+	sessions map[string][]byte
+	objects  map[string][]byte
+	failAt   map[int64]int
+	offsets  []int64
+	started  int
+}
+
+func newFakeGCSUpload() *fakeGCSUpload {
+	return &fakeGCSUpload{
+		sessions: map[string][]byte{},
+		objects:  map[string][]byte{},
+		failAt:   map[int64]int{},
+	}
+}
+
+func (f *fakeGCSUpload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/") {
+		if r.URL.Query().Get("uploadType") != "resumable" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.started++
+		session := fmt.Sprintf("/session/%d", f.started)
+		f.sessions[session] = []byte{}
+		w.Header().Set("Location", "http://"+r.Host+session+"?name="+r.URL.Query().Get("name"))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	data, ok := f.sessions[r.URL.Path]
+	if r.Method != http.MethodPut || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+
+	// Content-Range is bytes start-end/size or bytes */size
+	spec := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	rng, total, _ := strings.Cut(spec, "/")
+	size, _ := strconv.ParseInt(total, 10, 64)
+	if rng != "*" {
+		startStr, _, _ := strings.Cut(rng, "-")
+		start, _ := strconv.ParseInt(startStr, 10, 64)
+		f.offsets = append(f.offsets, start)
+		if f.failAt[start] > 0 {
+			f.failAt[start]--
+			// half the chunk is committed before failure
+			f.sessions[r.URL.Path] = append(data[:start], body[:len(body)/2]...)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if start != int64(len(data)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data = append(data, body...)
+		f.sessions[r.URL.Path] = data
+	}
+
+	if int64(len(data)) == size {
+		f.objects[r.URL.Query().Get("name")] = data
+		delete(f.sessions, r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"generation": "1"}`)
+		return
+	}
+	if len(data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(data)-1))
+	}
+	w.WriteHeader(statusResumeIncomplete)
+}
+
+func (f *fakeGCSUpload) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions = map[string][]byte{}
+}
+
+func newResumableTestClient(t *testing.T, endpoint string, policy RetryPolicy) *cloudStorageClient {
+	client, err := NewCloudStorageClient(CloudStorageClientConfig{
+		Endpoint:  endpoint,
+		Anonymous: true,
+		Retry:     &policy,
+		// rounded up to RESUMABLE_CHUNK_ALIGN
+		ChunkSize: OneKB,
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+	return client
+}
+
+func TestResumableUpload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := newFakeGCSUpload()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store, err := NewFileCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 40*1024)
+	cfr, err := NewCloudFileRequest("test-bucket", "large.bin", "resumable", 0)
+	require.NoError(t, err)
+	key := checkpointKey("test-bucket", "resumable/large.bin")
+
+	// worker fails after first chunk is committed
+	fake.failAt[RESUMABLE_CHUNK_ALIGN] = 1
+	client := newResumableTestClient(t, srv.URL, RetryPolicy{MaxAttempts: 1})
+	_, err = client.ResumableUpload(ctx, bytes.NewReader(data), cfr, store)
+	require.ErrorIs(t, err, ErrTransient)
+
+	cp, err := store.LoadCheckpoint(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, int64(RESUMABLE_CHUNK_ALIGN), cp.Offset)
+	require.Equal(t, int64(len(data)), cp.Size)
+
+	// restarted worker resumes at offset committed by storage
+	client = newResumableTestClient(t, srv.URL, RetryPolicy{MaxAttempts: 1})
+	n, err := client.ResumableUpload(ctx, bytes.NewReader(data), cfr, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, 1, fake.started)
+	require.Equal(t, []int64{0, RESUMABLE_CHUNK_ALIGN, RESUMABLE_CHUNK_ALIGN + RESUMABLE_CHUNK_ALIGN/2}, fake.offsets[:3])
+	require.Equal(t, data, fake.objects["resumable/large.bin"])
+
+	cp, err = store.LoadCheckpoint(ctx, key)
+	require.NoError(t, err)
+	require.Nil(t, cp)
+
+	// failed chunks are retried from committed offset
+	fake.offsets = nil
+	fake.failAt[RESUMABLE_CHUNK_ALIGN] = 1
+	client = newResumableTestClient(t, srv.URL, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	n, err = client.ResumableUpload(ctx, bytes.NewReader(data), cfr, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, 2, fake.started)
+	require.Equal(t, []int64{0, RESUMABLE_CHUNK_ALIGN, RESUMABLE_CHUNK_ALIGN + RESUMABLE_CHUNK_ALIGN/2}, fake.offsets[:3])
+	require.Equal(t, data, fake.objects["resumable/large.bin"])
+
+	// expired sessions restart upload
+	fake.failAt[RESUMABLE_CHUNK_ALIGN] = 1
+	client = newResumableTestClient(t, srv.URL, RetryPolicy{MaxAttempts: 1})
+	_, err = client.ResumableUpload(ctx, bytes.NewReader(data), cfr, store)
+	require.Error(t, err)
+	fake.expire()
+	n, err = client.ResumableUpload(ctx, bytes.NewReader(data), cfr, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, 4, fake.started)
+
+	// checkpoints of changed files of same size aren't resumed
+	fake.failAt[RESUMABLE_CHUNK_ALIGN] = 1
+	_, err = client.ResumableUpload(ctx, bytes.NewReader(data), cfr, store)
+	require.Error(t, err)
+	changed := bytes.Repeat([]byte("fedcba9876543210"), 40*1024)
+	n, err = client.ResumableUpload(ctx, bytes.NewReader(changed), cfr, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(changed)), n)
+	require.Equal(t, 6, fake.started)
+	require.Equal(t, changed, fake.objects["resumable/large.bin"])
+
+	// request modTime versions source, checkpoints of other modTimes aren't resumed
+	modCfr, err := NewCloudFileRequest("test-bucket", "mod.bin", "resumable", 1700000000)
+	require.NoError(t, err)
+	fake.failAt[RESUMABLE_CHUNK_ALIGN] = 1
+	_, err = client.ResumableUpload(ctx, bytes.NewReader(data), modCfr, store)
+	require.Error(t, err)
+	cp, err = store.LoadCheckpoint(ctx, checkpointKey("test-bucket", "resumable/mod.bin"))
+	require.NoError(t, err)
+	require.Equal(t, "modtime:1700000000", cp.Version)
+	modCfr, err = NewCloudFileRequest("test-bucket", "mod.bin", "resumable", 1700000001)
+	require.NoError(t, err)
+	n, err = client.ResumableUpload(ctx, bytes.NewReader(data), modCfr, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, 8, fake.started)
+
+	// source file modification time versions file sources, touched files aren't resumed
+	filePath := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(filePath, data, 0o600))
+	file, err := os.Open(filePath)
+	require.NoError(t, err)
+	defer file.Close()
+	fileCfr, err := NewCloudFileRequest("test-bucket", "file.bin", "resumable", 0)
+	require.NoError(t, err)
+	fake.failAt[RESUMABLE_CHUNK_ALIGN] = 1
+	_, err = client.ResumableUpload(ctx, file, fileCfr, store)
+	require.Error(t, err)
+	cp, err = store.LoadCheckpoint(ctx, checkpointKey("test-bucket", "resumable/file.bin"))
+	require.NoError(t, err)
+	require.Equal(t, true, strings.HasPrefix(cp.Version, "mtime:"))
+	touched := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filePath, touched, touched))
+	n, err = client.ResumableUpload(ctx, file, fileCfr, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, 10, fake.started)
+	require.Equal(t, data, fake.objects["resumable/file.bin"])
+
+	// empty files are uploaded with a single request
+	empty, err := NewCloudFileRequest("test-bucket", "empty.bin", "resumable", 0)
+	require.NoError(t, err)
+	n, err = client.ResumableUpload(ctx, bytes.NewReader(nil), empty, store)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+	require.Equal(t, []byte{}, fake.objects["resumable/empty.bin"])
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := NewFileCheckpointStore("")
+	require.ErrorIs(t, err, ErrFilePathMissing)
+
+	store, err := NewFileCheckpointStore(t.TempDir())
+	require.NoError(t, err)
+	cp, err := store.LoadCheckpoint(ctx, "gs://test-bucket/missing")
+	require.NoError(t, err)
+	require.Nil(t, cp)
+
+	saved := UploadCheckpoint{Bucket: "test-bucket", Name: "a/b.bin", SessionURI: "http://session", Size: 10, Offset: 5, Updated: time.Now().UTC()}
+	require.NoError(t, store.SaveCheckpoint(ctx, "gs://test-bucket/a/b.bin", saved))
+	cp, err = store.LoadCheckpoint(ctx, "gs://test-bucket/a/b.bin")
+	require.NoError(t, err)
+	require.Equal(t, saved.SessionURI, cp.SessionURI)
+	require.Equal(t, saved.Offset, cp.Offset)
+	require.Equal(t, true, saved.Updated.Equal(cp.Updated))
+
+	require.NoError(t, store.DeleteCheckpoint(ctx, "gs://test-bucket/a/b.bin"))
+	require.NoError(t, store.DeleteCheckpoint(ctx, "gs://test-bucket/a/b.bin"))
+	cp, err = store.LoadCheckpoint(ctx, "gs://test-bucket/a/b.bin")
+	require.NoError(t, err)
+	require.Nil(t, cp)
+
+	require.Equal(t, int64(1024), committedOffset("bytes=0-1023"))
+	require.Equal(t, int64(0), committedOffset(""))
+}
@@ -0,0 +1,166 @@
+package cloudstorage
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/comfforts/logger"
+	"github.com/googleapis/gax-go/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS       = 3
+	DEFAULT_INITIAL_BACKOFF    = time.Second
+	DEFAULT_MAX_BACKOFF        = 30 * time.Second
+	DEFAULT_BACKOFF_MULTIPLIER = 2.0
+	DEFAULT_BACKOFF_JITTER     = 0.2
+)
+
+// RetryPolicy configures retries of failed storage calls with exponential backoff,
+// only idempotent calls, e.g. reads & uploads guarded by preconditions, are retried by default
+type RetryPolicy struct {
+	// MaxAttempts is max number of call attempts, DEFAULT_MAX_ATTEMPTS when zero, 1 disables retries
+	MaxAttempts int `json:"max_attempts"`
+	// InitialBackoff is wait before first retry, DEFAULT_INITIAL_BACKOFF when zero
+	InitialBackoff time.Duration `json:"initial_backoff"`
+	// MaxBackoff caps wait between retries, DEFAULT_MAX_BACKOFF when zero
+	MaxBackoff time.Duration `json:"max_backoff"`
+	// Multiplier grows backoff after each retry, DEFAULT_BACKOFF_MULTIPLIER when less than 1
+	Multiplier float64 `json:"multiplier"`
+	// Jitter randomizes backoff by given fraction, 0.2 waits 80% to 120% of backoff, none when zero
+	Jitter float64 `json:"jitter"`
+	// RetryableKinds are retried error kinds, ErrTransient & ErrRateLimited when empty
+	RetryableKinds []error `json:"-"`
+	// RetryNonIdempotent also retries calls unsafe to repeat, e.g. unconditional uploads & deletes
+	RetryNonIdempotent bool `json:"retry_non_idempotent"`
+}
+
+// DefaultRetryPolicy returns retry policy used when client config doesn't set one
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DEFAULT_MAX_ATTEMPTS,
+		InitialBackoff: DEFAULT_INITIAL_BACKOFF,
+		MaxBackoff:     DEFAULT_MAX_BACKOFF,
+		Multiplier:     DEFAULT_BACKOFF_MULTIPLIER,
+		Jitter:         DEFAULT_BACKOFF_JITTER,
+	}
+}
+
+// withDefaults returns policy with defaults for unset attributes
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if rp.InitialBackoff <= 0 {
+		rp.InitialBackoff = DEFAULT_INITIAL_BACKOFF
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if rp.MaxBackoff < rp.InitialBackoff {
+		rp.MaxBackoff = rp.InitialBackoff
+	}
+	if rp.Multiplier < 1 {
+		rp.Multiplier = DEFAULT_BACKOFF_MULTIPLIER
+	}
+	if rp.Jitter < 0 {
+		rp.Jitter = 0
+	}
+	if rp.Jitter > 1 {
+		rp.Jitter = 1
+	}
+	if len(rp.RetryableKinds) == 0 {
+		rp.RetryableKinds = []error{ErrTransient, ErrRateLimited}
+	}
+	return rp
+}
+
+// retryable checks if error is of a retryable kind
+func (rp RetryPolicy) retryable(err error) bool {
+	kind := errorKind(err)
+	for _, retryKind := range rp.RetryableKinds {
+		if kind == retryKind || isKind(err, retryKind) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns jittered wait before given retry, starting at 1
+func (rp RetryPolicy) backoff(retry int) time.Duration {
+	wait := float64(rp.InitialBackoff)
+	for i := 1; i < retry && wait < float64(rp.MaxBackoff); i++ {
+		wait *= rp.Multiplier
+	}
+	if wait > float64(rp.MaxBackoff) {
+		wait = float64(rp.MaxBackoff)
+	}
+	if rp.Jitter > 0 {
+		wait *= 1 + rp.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(wait)
+}
+
+// retry calls fn with attempt number, starting at 1, until it succeeds, fails with non retryable error,
+// attempts run out or context is done. Non idempotent calls are attempted once, unless policy retries them
+func (rp RetryPolicy) retry(ctx context.Context, logger logger.AppLogger, op string, idempotent bool, fn func(attempt int) error) error {
+	attempts := rp.MaxAttempts
+	if !idempotent && !rp.RetryNonIdempotent {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("storage call succeeded after retries", zap.String("op", op), zap.Int("attempts", attempt))
+			}
+			return nil
+		}
+		if attempt >= attempts || !rp.retryable(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				logger.Error("storage call failed after retries", zap.Error(err), zap.String("op", op), zap.Int("attempts", attempt))
+			}
+			return err
+		}
+
+		wait := rp.backoff(attempt)
+		logger.Info("retrying storage call", zap.Error(err), zap.String("op", op), zap.Int("attempt", attempt), zap.Int("maxAttempts", attempts), zap.Duration("backoff", wait))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// gcsRetryOptions returns storage library retry options for given policy, used by listing iterators,
+// which retry pages with policy backoff & retryable kinds, bounded by context rather than attempts
+func (rp RetryPolicy) gcsRetryOptions() []storage.RetryOption {
+	policy := storage.RetryIdempotent
+	if rp.RetryNonIdempotent {
+		policy = storage.RetryAlways
+	}
+	if rp.MaxAttempts == 1 {
+		policy = storage.RetryNever
+	}
+	return []storage.RetryOption{
+		storage.WithBackoff(gax.Backoff{
+			Initial:    rp.InitialBackoff,
+			Max:        rp.MaxBackoff,
+			Multiplier: rp.Multiplier,
+		}),
+		storage.WithPolicy(policy),
+		storage.WithErrorFunc(rp.retryable),
+	}
+}
+
+// object returns object handle retried by client retry policy, with storage library retries disabled
+func (cs *cloudStorageClient) object(bucket, name string) *storage.ObjectHandle {
+	return cs.client.Bucket(bucket).Object(name).Retryer(storage.WithPolicy(storage.RetryNever))
+}
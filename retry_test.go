@@ -0,0 +1,115 @@
+package cloudstorage
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policy := RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     4 * time.Millisecond,
+	}.withDefaults()
+	unavailable := &responseError{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}
+	forbidden := &responseError{StatusCode: http.StatusForbidden, Code: "AccessDenied"}
+
+	// transient errors are retried until call succeeds
+	calls := 0
+	err := policy.retry(ctx, appLogger, "stat", true, func(attempt int) error {
+		calls++
+		require.Equal(t, calls, attempt)
+		if attempt < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// until attempts run out
+	calls = 0
+	err = policy.retry(ctx, appLogger, "stat", true, func(attempt int) error {
+		calls++
+		return wrapStorageError(unavailable, "cloud file inaccessible")
+	})
+	require.ErrorIs(t, err, ErrTransient)
+	require.Equal(t, 4, calls)
+
+	// non retryable errors & non idempotent calls are attempted once
+	calls = 0
+	err = policy.retry(ctx, appLogger, "stat", true, func(attempt int) error {
+		calls++
+		return forbidden
+	})
+	require.Equal(t, forbidden, err)
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	err = policy.retry(ctx, appLogger, "upload", false, func(attempt int) error {
+		calls++
+		return unavailable
+	})
+	require.Equal(t, unavailable, err)
+	require.Equal(t, 1, calls)
+
+	policy.RetryNonIdempotent = true
+	calls = 0
+	err = policy.retry(ctx, appLogger, "upload", false, func(attempt int) error {
+		calls++
+		return unavailable
+	})
+	require.Equal(t, unavailable, err)
+	require.Equal(t, 4, calls)
+
+	// retryable kinds are configurable
+	policy.RetryableKinds = []error{ErrPermissionDenied}
+	calls = 0
+	err = policy.retry(ctx, appLogger, "stat", true, func(attempt int) error {
+		calls++
+		return forbidden
+	})
+	require.Equal(t, forbidden, err)
+	require.Equal(t, 4, calls)
+
+	// cancelled calls aren't retried
+	cCtx, cCancel := context.WithCancel(ctx)
+	cCancel()
+	calls = 0
+	err = policy.retry(cCtx, appLogger, "stat", true, func(attempt int) error {
+		calls++
+		return forbidden
+	})
+	require.Equal(t, forbidden, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     3,
+	}.withDefaults()
+	require.Equal(t, 10*time.Millisecond, policy.backoff(1))
+	require.Equal(t, 30*time.Millisecond, policy.backoff(2))
+	require.Equal(t, 50*time.Millisecond, policy.backoff(3))
+	require.Equal(t, 50*time.Millisecond, policy.backoff(10))
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		wait := policy.backoff(2)
+		require.Equal(t, true, wait >= 24*time.Millisecond && wait <= 36*time.Millisecond)
+	}
+
+	require.Equal(t, DEFAULT_MAX_ATTEMPTS, RetryPolicy{}.withDefaults().MaxAttempts)
+	require.Equal(t, 1, RetryPolicy{MaxAttempts: 1}.withDefaults().MaxAttempts)
+}
@@ -0,0 +1,999 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/comfforts/errors"
+	"github.com/comfforts/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	S3_SCHEME                  = "s3"
+	DEFAULT_S3_REGION          = "us-east-1"
+	MIN_S3_PART_SIZE     int64 = 5 * 1024 * 1024
+	DEFAULT_S3_PART_SIZE int64 = 8 * 1024 * 1024
+	s3MetaHeaderPrefix         = "X-Amz-Meta-"
+)
+
+func init() {
+	// s3:// for AWS S3, s3://host:port for S3 compatible endpoint,
+	// with query params region, path_style & insecure for plain http endpoint
+	RegisterBackend(S3_SCHEME, func(cfg CloudStorageClientConfig, storageURL *url.URL, logger logger.AppLogger) (CloudStorage, error) {
+		if err := rejectGCSOnlyConfig(cfg, logger); err != nil {
+			return nil, err
+		}
+		query := storageURL.Query()
+		s3Cfg := S3ClientConfig{
+			Region: query.Get("region"),
+		}
+		if storageURL.Host != "" {
+			scheme := "https"
+			if insecure, _ := strconv.ParseBool(query.Get("insecure")); insecure {
+				scheme = "http"
+			}
+			s3Cfg.Endpoint = scheme + "://" + storageURL.Host
+		}
+		if pathStyle := query.Get("path_style"); pathStyle != "" {
+			ok, err := strconv.ParseBool(pathStyle)
+			if err != nil {
+				logger.Error(ERROR_INVALID_STORAGE_URL, zap.String("storageURL", cfg.StorageURL))
+				return nil, ErrInvalidStorageURL
+			}
+			s3Cfg.PathStyle = ok
+		}
+		return NewS3StorageClient(s3Cfg, logger)
+	})
+}
+
+// S3ClientConfig configures S3 compatible storage client
+type S3ClientConfig struct {
+	// Endpoint is S3 compatible service URL, e.g. http://localhost:9000, regional AWS S3 endpoint when empty
+	Endpoint string `json:"endpoint"`
+	// Region is signing region, from AWS_REGION or AWS_DEFAULT_REGION when empty, us-east-1 if not set
+	Region string `json:"region"`
+	// PathStyle addresses buckets as endpoint path instead of endpoint subdomain, as MinIO expects
+	PathStyle bool `json:"path_style"`
+	// Credentials are static credentials, AWS environment credentials are used when nil,
+	// requests are sent unsigned without credentials
+	Credentials *S3Credentials `json:"credentials"`
+	// PartSize is multipart upload part size, uploads larger than part size are sent in parts
+	PartSize   int64        `json:"part_size"`
+	HTTPClient *http.Client `json:"-"`
+}
+
+type s3StorageClient struct {
+	config   S3ClientConfig
+	endpoint *url.URL
+	creds    S3Credentials
+	client   *http.Client
+	logger   logger.AppLogger
+}
+
+// NewS3StorageClient takes S3 client config & logger, returns S3 compatible storage client
+func NewS3StorageClient(cfg S3ClientConfig, logger logger.AppLogger) (*s3StorageClient, error) {
+	if logger == nil {
+		return nil, errors.NewAppError(errors.ERROR_MISSING_REQUIRED)
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_REGION")
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Region == "" {
+		cfg.Region = DEFAULT_S3_REGION
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = DEFAULT_S3_PART_SIZE
+	}
+	if cfg.PartSize < MIN_S3_PART_SIZE {
+		cfg.PartSize = MIN_S3_PART_SIZE
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		logger.Error(ERROR_CREATING_STORAGE_CLIENT, zap.String("endpoint", cfg.Endpoint))
+		return nil, ErrInvalidStorageURL
+	}
+
+	creds := s3EnvCredentials()
+	if cfg.Credentials != nil {
+		creds = *cfg.Credentials
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &s3StorageClient{
+		config:   cfg,
+		endpoint: endpoint,
+		creds:    creds,
+		client:   client,
+		logger:   logger,
+	}, nil
+}
+
+// objectURL returns URL for bucket object, bucket URL when key is empty
+func (sc *s3StorageClient) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := *sc.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if sc.config.PathStyle {
+		p = p + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		p = p + "/" + key
+	}
+	u.Path = p
+	u.RawPath = escapePath(p)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do sends signed request for bucket object, returns response or, for error status, response error
+func (sc *s3StorageClient) do(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, sc.objectURL(bucket, key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	if !sc.creds.anonymous() {
+		payloadHash := S3_EMPTY_PAYLOAD
+		if len(body) > 0 {
+			sum := sha256.Sum256(body)
+			payloadHash = hex.EncodeToString(sum[:])
+		}
+		signS3Request(req, sc.creds, sc.config.Region, payloadHash, time.Now())
+	}
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		return nil, s3ResponseError(resp)
+	}
+	return resp, nil
+}
+
+// s3ErrorResponse is S3 error response body
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// s3ResponseError returns response error for S3 error response
+func s3ResponseError(resp *http.Response) error {
+	rErr := &responseError{
+		StatusCode: resp.StatusCode,
+		Code:       http.StatusText(resp.StatusCode),
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	errResp := s3ErrorResponse{}
+	if len(data) > 0 && xml.Unmarshal(data, &errResp) == nil {
+		rErr.Code = errResp.Code
+		rErr.Message = errResp.Message
+	}
+	return rErr
+}
+
+// decodeS3Response decodes XML response body into given value,
+// some S3 operations report failures as an error body with success status
+func decodeS3Response(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	errResp := s3ErrorResponse{}
+	if xml.Unmarshal(data, &errResp) == nil {
+		return &responseError{
+			StatusCode: http.StatusInternalServerError,
+			Code:       errResp.Code,
+			Message:    errResp.Message,
+		}
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return wrapStorageError(err, ERROR_DECODING_RESPONSE)
+	}
+	return nil
+}
+
+// s3MD5 returns MD5 checksum held by entity tag, nil for multipart or encrypted object tags
+func s3MD5(etag string) []byte {
+	sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(sum) != 16 {
+		return nil
+	}
+	return sum
+}
+
+// s3ObjectInfo takes bucket, key & object response header, returns object info
+func s3ObjectInfo(bucket, key string, header http.Header) ObjectInfo {
+	etag := header.Get("ETag")
+	updated, _ := http.ParseTime(header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	info := ObjectInfo{
+		Bucket:          bucket,
+		Name:            key,
+		Size:            size,
+		ContentType:     header.Get("Content-Type"),
+		ContentEncoding: header.Get("Content-Encoding"),
+		Generation:      etagGeneration(etag),
+		Metageneration:  1,
+		StorageClass:    header.Get("X-Amz-Storage-Class"),
+		ETag:            etag,
+		MD5:             s3MD5(etag),
+		Created:         updated,
+		Updated:         updated,
+	}
+	if info.StorageClass == "" {
+		info.StorageClass = DEFAULT_STORAGE_CLASS
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, s3MetaHeaderPrefix) && len(values) > 0 {
+			if info.Metadata == nil {
+				info.Metadata = map[string]string{}
+			}
+			info.Metadata[strings.ToLower(name[len(s3MetaHeaderPrefix):])] = values[0]
+		}
+	}
+	return info
+}
+
+// headObject returns object info, object not found error if object doesn't exist
+func (sc *s3StorageClient) headObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	resp, err := sc.do(ctx, http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, wrapStorageError(err, "s3 file inaccessible %s", key)
+	}
+	resp.Body.Close()
+	return s3ObjectInfo(bucket, key, resp.Header), nil
+}
+
+// pinnedObject returns info of object pinned to request generation, stale download error if object was replaced
+func (sc *s3StorageClient) pinnedObject(ctx context.Context, bucket, key string, gen int64) (ObjectInfo, error) {
+	info, err := sc.headObject(ctx, bucket, key)
+	if err != nil {
+		if gen > 0 && isKind(err, ErrObjectNotFound) {
+			return ObjectInfo{}, kindError(ErrStaleDownload, err)
+		}
+		return ObjectInfo{}, err
+	}
+	if gen > 0 && info.Generation != gen {
+		return ObjectInfo{}, kindError(ErrStaleDownload, nil)
+	}
+	return info, nil
+}
+
+// s3WriteHeader returns object attribute headers for request, starting from given base attributes
+func s3WriteHeader(cfr CloudFileRequest, base *ObjectInfo) http.Header {
+	header := http.Header{}
+	info := ObjectInfo{}
+	if base != nil {
+		info = *base
+	}
+	if cfr.contentType != "" {
+		info.ContentType = cfr.contentType
+	}
+	if cfr.storageClass != "" {
+		info.StorageClass = cfr.storageClass
+	}
+	if cfr.metadata != nil {
+		info.Metadata = cfr.metadata
+	}
+
+	if info.ContentType != "" {
+		header.Set("Content-Type", info.ContentType)
+	}
+	if info.ContentEncoding != "" {
+		header.Set("Content-Encoding", info.ContentEncoding)
+	}
+	if info.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", info.StorageClass)
+	}
+	for k, v := range info.Metadata {
+		header.Set(s3MetaHeaderPrefix+k, v)
+	}
+	return header
+}
+
+// currentObject returns object info, nil if object doesn't exist
+func (sc *s3StorageClient) currentObject(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	info, err := sc.headObject(ctx, bucket, key)
+	if err != nil {
+		if isKind(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &info, nil
+}
+
+// UploadFile uploads file in one request, or in parts when larger than configured part size
+func (sc *s3StorageClient) UploadFile(ctx context.Context, file io.Reader, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	key := cfr.objectName()
+
+	var current *ObjectInfo
+	if cfr.isConditional() {
+		info, err := sc.currentObject(ctx, cfr.bucket, key)
+		if err != nil {
+			sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", key))
+			return 0, err
+		}
+		current = info
+	}
+
+	// guard against replacing newer or concurrently updated objects
+	conds, err := writeConditionHeaders(cfr, current)
+	if err != nil {
+		sc.logger.Error(ERROR_STALE_UPLOAD, zap.String("filepath", key), zap.Int64("modTime", cfr.modTime), zap.Int64("generation", cfr.generation))
+		return 0, err
+	}
+
+	// files smaller than part size are uploaded in one request
+	first := bytes.Buffer{}
+	n, err := io.CopyN(&first, file, sc.config.PartSize)
+	if err != nil && err != io.EOF {
+		sc.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", key))
+		return 0, wrapStorageError(err, "error uploading file %s", key)
+	}
+	header := s3WriteHeader(cfr, nil)
+	// sniff content type like cloud uploads do
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(first.Bytes()))
+	}
+
+	var nBytes int64
+	if n < sc.config.PartSize {
+		for name, values := range conds {
+			header[name] = values
+		}
+		resp, pErr := sc.do(ctx, http.MethodPut, cfr.bucket, key, nil, header, first.Bytes())
+		if pErr == nil {
+			resp.Body.Close()
+		}
+		nBytes, err = n, pErr
+	} else {
+		nBytes, err = sc.multipartUpload(ctx, cfr.bucket, key, header, conds, first.Bytes(), file)
+	}
+	if err != nil {
+		if isWriteConflict(err) {
+			sc.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("filepath", key))
+			return 0, kindError(ErrStaleUpload, err)
+		}
+		sc.logger.Error("error uploading file", zap.Error(err), zap.String("filepath", key))
+		return 0, wrapStorageError(err, "error uploading file %s", key)
+	}
+	sc.logger.Debug("s3 file created/updated", zap.String("filepath", key), zap.Int64("size", nBytes))
+	return nBytes, nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// multipartUpload uploads given full first part & rest of reader in parts, reusing first part buffer,
+// upload is committed with given write conditions & aborted on failure
+func (sc *s3StorageClient) multipartUpload(ctx context.Context, bucket, key string, header, conds http.Header, buf []byte, r io.Reader) (int64, error) {
+	resp, err := sc.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	initResult := s3InitiateMultipartUploadResult{}
+	if err := decodeS3Response(resp, &initResult); err != nil {
+		return 0, err
+	}
+	uploadID := initResult.UploadID
+
+	nBytes, err := sc.uploadParts(ctx, bucket, key, uploadID, conds, buf, r)
+	if err != nil {
+		// abort independent of request context, so parts are not left behind
+		if resp, aErr := sc.do(context.Background(), http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil); aErr != nil {
+			sc.logger.Error("error aborting s3 multipart upload", zap.Error(aErr), zap.String("filepath", key), zap.String("uploadId", uploadID))
+		} else {
+			resp.Body.Close()
+		}
+		return 0, err
+	}
+	return nBytes, nil
+}
+
+// uploadParts uploads parts of multipart upload & completes it, returns uploaded bytes
+func (sc *s3StorageClient) uploadParts(ctx context.Context, bucket, key, uploadID string, conds http.Header, buf []byte, r io.Reader) (int64, error) {
+	complete := s3CompleteMultipartUpload{}
+	var nBytes int64
+	n := len(buf)
+	for partNum := 1; n > 0; partNum++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNum)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := sc.do(ctx, http.MethodPut, bucket, key, query, nil, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNum, ETag: resp.Header.Get("ETag")})
+		nBytes += int64(n)
+		sc.logger.Debug("uploaded s3 file part", zap.String("filepath", key), zap.Int("part", partNum), zap.Int("size", n))
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := sc.do(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, conds, body)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := decodeS3Response(resp, &result); err != nil {
+		return 0, err
+	}
+	return nBytes, nil
+}
+
+func (sc *s3StorageClient) DownloadFile(ctx context.Context, file io.Writer, cfr CloudFileRequest) (int64, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	key := cfr.objectName()
+
+	header := http.Header{}
+	if cfr.generation > 0 {
+		info, err := sc.pinnedObject(ctx, cfr.bucket, key, cfr.generation)
+		if err != nil {
+			sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", key))
+			return 0, err
+		}
+		header.Set("If-Match", info.ETag)
+	}
+
+	resp, err := sc.do(ctx, http.MethodGet, cfr.bucket, key, nil, header, nil)
+	if err != nil {
+		if cfr.generation > 0 && (isPreconditionFailed(err) || hasStatus(err, http.StatusNotFound)) {
+			sc.logger.Error(ERROR_STALE_DOWNLOAD, zap.Error(err), zap.String("filepath", key))
+			return 0, kindError(ErrStaleDownload, err)
+		}
+		sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", key))
+		return 0, wrapStorageError(err, "s3 file inaccessible %s", key)
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(file, resp.Body)
+	if err != nil {
+		sc.logger.Error("error copying s3 file", zap.Error(err), zap.String("filepath", key))
+		return n, wrapStorageError(err, "error copying cloud file %s", key)
+	}
+	return n, nil
+}
+
+// rangeReader returns range reader func for object, reads are pinned to given entity tag when set
+func (sc *s3StorageClient) rangeReader(bucket, key, etag string) rangeReaderFunc {
+	return func(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+		header := http.Header{}
+		if length < 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		} else {
+			header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+		}
+		if etag != "" {
+			header.Set("If-Match", etag)
+		}
+
+		resp, err := sc.do(ctx, http.MethodGet, bucket, key, nil, header, nil)
+		if err != nil {
+			if isRangeNotSatisfiable(err) {
+				return nil, io.EOF
+			}
+			// pinned object replaced or removed
+			if etag != "" && (isPreconditionFailed(err) || hasStatus(err, http.StatusNotFound)) {
+				return nil, kindError(ErrStaleDownload, err)
+			}
+			return nil, wrapStorageError(err, "error reading cloud file %s", key)
+		}
+		return resp.Body, nil
+	}
+}
+
+func (sc *s3StorageClient) ReadAt(ctx context.Context, cfr CloudFileRequest, p []byte, off int64) (int, error) {
+	if cfr.file == "" {
+		return 0, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return 0, ErrBucketNameMissing
+	}
+	key := cfr.objectName()
+	cfr, err := cfr.pinReads(ctx, sc.StatObject)
+	if err != nil {
+		return 0, err
+	}
+
+	// etag of pinned generation is known once request pinned it
+	etag := cfr.pinnedETag()
+	if cfr.generation > 0 && etag == "" {
+		info, err := sc.pinnedObject(ctx, cfr.bucket, key, cfr.generation)
+		if err != nil {
+			sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", key))
+			return 0, err
+		}
+		etag = info.ETag
+	}
+
+	co := newCloudObject(ctx, key, -1, cfr.generation, sc.rangeReader(cfr.bucket, key, etag))
+	return co.ReadAt(p, off)
+}
+
+func (sc *s3StorageClient) StatObject(ctx context.Context, cfr CloudFileRequest) (ObjectInfo, error) {
+	if cfr.bucket == "" {
+		return ObjectInfo{}, ErrBucketNameMissing
+	}
+	if cfr.file == "" {
+		return ObjectInfo{}, ErrFileNameMissing
+	}
+	return sc.headObject(ctx, cfr.bucket, cfr.objectName())
+}
+
+func (sc *s3StorageClient) OpenObject(ctx context.Context, cfr CloudFileRequest) (CloudObject, error) {
+	if cfr.file == "" {
+		return nil, ErrFileNameMissing
+	}
+	if cfr.bucket == "" {
+		return nil, ErrBucketNameMissing
+	}
+	key := cfr.objectName()
+
+	info, err := sc.pinnedObject(ctx, cfr.bucket, key, cfr.generation)
+	if err != nil {
+		sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", key))
+		return nil, err
+	}
+
+	// pin all reads through the handle to opened object entity tag
+	return newCloudObject(ctx, key, info.Size, info.Generation, sc.rangeReader(cfr.bucket, key, info.ETag)), nil
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+		StorageClass string    `xml:"StorageClass"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// s3ListReached reports whether listed keys or prefixes reach given end offset, false if there is none
+func s3ListReached(result s3ListBucketResult, endOffset string) bool {
+	if endOffset == "" {
+		return false
+	}
+	if n := len(result.Contents); n > 0 && result.Contents[n-1].Key >= endOffset {
+		return true
+	}
+	if n := len(result.CommonPrefixes); n > 0 && result.CommonPrefixes[n-1].Prefix >= endOffset {
+		return true
+	}
+	return false
+}
+
+// listPage lists one page of request objects, server default page size when max keys is 0
+func (sc *s3StorageClient) listPage(ctx context.Context, req CloudFileRequest, maxKeys int, pageToken string) (ObjectList, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {req.listPrefix()},
+	}
+	if req.delimiter != "" {
+		query.Set("delimiter", req.delimiter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if pageToken != "" {
+		query.Set("continuation-token", pageToken)
+	}
+	// start-after is exclusive, listing after start offset without its last character includes start offset,
+	// keys in between are filtered below
+	if req.startOffset != "" {
+		_, size := utf8.DecodeLastRuneInString(req.startOffset)
+		query.Set("start-after", req.startOffset[:len(req.startOffset)-size])
+	}
+
+	resp, err := sc.do(ctx, http.MethodGet, req.bucket, "", query, nil, nil)
+	if err != nil {
+		return ObjectList{}, wrapStorageError(err, ERROR_LISTING_OBJECTS)
+	}
+	result := s3ListBucketResult{}
+	if err := decodeS3Response(resp, &result); err != nil {
+		return ObjectList{}, wrapStorageError(err, ERROR_LISTING_OBJECTS)
+	}
+
+	// offsets & glob filter apply after paging, a page may hold fewer than page size objects
+	list := ObjectList{
+		Objects:  []ObjectInfo{},
+		Prefixes: []string{},
+	}
+	// keys are listed in order, no later page holds keys before end offset
+	if result.IsTruncated && !s3ListReached(result, req.endOffset) {
+		list.NextPageToken = result.NextContinuationToken
+	}
+	for _, prefix := range result.CommonPrefixes {
+		list.Prefixes = append(list.Prefixes, prefix.Prefix)
+	}
+	for _, obj := range result.Contents {
+		if req.startOffset != "" && obj.Key < req.startOffset {
+			continue
+		}
+		if req.endOffset != "" && obj.Key >= req.endOffset {
+			continue
+		}
+		if !req.matchGlob(obj.Key) {
+			continue
+		}
+		storageClass := obj.StorageClass
+		if storageClass == "" {
+			storageClass = DEFAULT_STORAGE_CLASS
+		}
+		list.Objects = append(list.Objects, ObjectInfo{
+			Bucket:         req.bucket,
+			Name:           obj.Key,
+			Size:           obj.Size,
+			Generation:     etagGeneration(obj.ETag),
+			Metageneration: 1,
+			StorageClass:   storageClass,
+			ETag:           obj.ETag,
+			MD5:            s3MD5(obj.ETag),
+			Created:        obj.LastModified,
+			Updated:        obj.LastModified,
+		})
+	}
+	return list, nil
+}
+
+func (sc *s3StorageClient) ListObjects(ctx context.Context, req CloudFileRequest) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+
+	list := ObjectList{
+		Objects:  []ObjectInfo{},
+		Prefixes: []string{},
+	}
+	pageToken := ""
+	for {
+		page, err := sc.listPage(ctx, req, 0, pageToken)
+		if err != nil {
+			sc.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+			return list, err
+		}
+		list.Objects = append(list.Objects, page.Objects...)
+		list.Prefixes = append(list.Prefixes, page.Prefixes...)
+		if page.NextPageToken == "" {
+			return list, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// ListObjectsPage takes page size & page token, empty for first page, returns one page of listing
+func (sc *s3StorageClient) ListObjectsPage(ctx context.Context, req CloudFileRequest, pageSize int, pageToken string) (ObjectList, error) {
+	if err := req.validateList(); err != nil {
+		return ObjectList{}, err
+	}
+	if pageSize <= 0 {
+		return ObjectList{}, ErrInvalidPageSize
+	}
+
+	list, err := sc.listPage(ctx, req, pageSize, pageToken)
+	if err != nil {
+		sc.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()), zap.String("pageToken", pageToken))
+		return ObjectList{}, err
+	}
+	return list, nil
+}
+
+// StreamObjects streams list entries page by page, channel is closed when listing ends,
+// on listing error, after sending error entry, or on context cancellation
+func (sc *s3StorageClient) StreamObjects(ctx context.Context, req CloudFileRequest) <-chan ListEntry {
+	entryStream := make(chan ListEntry)
+
+	go func() {
+		defer close(entryStream)
+
+		if err := req.validateList(); err != nil {
+			sendListEntry(ctx, entryStream, ListEntry{Err: err})
+			return
+		}
+
+		pageToken := ""
+		for {
+			page, err := sc.listPage(ctx, req, 0, pageToken)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				sc.logger.Error(ERROR_LISTING_OBJECTS, zap.Error(err), zap.String("prefix", req.listPrefix()))
+				sendListEntry(ctx, entryStream, ListEntry{Err: err})
+				return
+			}
+			for _, prefix := range page.Prefixes {
+				if !sendListEntry(ctx, entryStream, ListEntry{Prefix: prefix}) {
+					return
+				}
+			}
+			for i := range page.Objects {
+				if !sendListEntry(ctx, entryStream, ListEntry{Object: &page.Objects[i]}) {
+					return
+				}
+			}
+			if page.NextPageToken == "" {
+				return
+			}
+			pageToken = page.NextPageToken
+		}
+	}()
+
+	return entryStream
+}
+
+func (sc *s3StorageClient) CopyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	info, _, err := sc.copyObject(ctx, src, dst)
+	return info, err
+}
+
+func (sc *s3StorageClient) MoveObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, error) {
+	info, srcInfo, err := sc.copyObject(ctx, src, dst)
+	if err != nil {
+		return info, err
+	}
+
+	// move onto itself rewrites attributes only
+	srcKey := src.objectName()
+	if src.bucket == dst.bucket && srcKey == info.Name {
+		return info, nil
+	}
+
+	// delete only copied source object
+	resp, err := sc.do(ctx, http.MethodDelete, src.bucket, srcKey, nil, http.Header{"If-Match": {srcInfo.ETag}}, nil)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			sc.logger.Error(ERROR_STALE_DOWNLOAD, zap.Error(err), zap.String("src", srcKey))
+			sc.rollbackCopy(ctx, info)
+			return ObjectInfo{}, kindError(ErrStaleDownload, err)
+		}
+		sc.logger.Error(ERROR_MOVING_OBJECT, zap.Error(err), zap.String("src", srcKey))
+		return info, wrapStorageError(err, ERROR_MOVING_OBJECT)
+	}
+	resp.Body.Close()
+	sc.logger.Debug("moved s3 file", zap.String("src", srcKey), zap.String("dst", info.Name))
+	return info, nil
+}
+
+// rollbackCopy deletes copied destination object of a failed move, leaving replaced destinations alone
+func (sc *s3StorageClient) rollbackCopy(ctx context.Context, info ObjectInfo) {
+	resp, err := sc.do(ctx, http.MethodDelete, info.Bucket, info.Name, nil, http.Header{"If-Match": {info.ETag}}, nil)
+	if err != nil {
+		sc.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("dst", info.Name))
+		return
+	}
+	resp.Body.Close()
+}
+
+type s3CopyObjectResult struct {
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// copyObject copies source to destination server side, pinned to source entity tag at copy start,
+// returns destination & copied source object info. Single request copies are limited to 5GB objects
+func (sc *s3StorageClient) copyObject(ctx context.Context, src, dst CloudFileRequest) (ObjectInfo, ObjectInfo, error) {
+	if src.bucket == "" || dst.bucket == "" {
+		return ObjectInfo{}, ObjectInfo{}, ErrBucketNameMissing
+	}
+	if src.file == "" || dst.file == "" {
+		return ObjectInfo{}, ObjectInfo{}, ErrFileNameMissing
+	}
+	srcKey, dstKey := src.objectName(), dst.objectName()
+
+	srcInfo, err := sc.pinnedObject(ctx, src.bucket, srcKey, src.generation)
+	if err != nil {
+		sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", srcKey))
+		return ObjectInfo{}, ObjectInfo{}, err
+	}
+
+	// destination preconditions, modification time applies to uploads only
+	dst.modTime = 0
+	var current *ObjectInfo
+	if dst.isConditional() {
+		current, err = sc.currentObject(ctx, dst.bucket, dstKey)
+		if err != nil {
+			sc.logger.Error("s3 file inaccessible", zap.Error(err), zap.String("filepath", dstKey))
+			return ObjectInfo{}, ObjectInfo{}, err
+		}
+	}
+	header, err := writeConditionHeaders(dst, current)
+	if err != nil {
+		sc.logger.Error(ERROR_STALE_UPLOAD, zap.String("src", srcKey), zap.String("dst", dstKey))
+		return ObjectInfo{}, ObjectInfo{}, err
+	}
+
+	// keep source attributes for fields not overridden
+	for name, values := range s3WriteHeader(dst, &srcInfo) {
+		header[name] = values
+	}
+	header.Set("X-Amz-Copy-Source", escapePath("/"+src.bucket+"/"+srcKey))
+	header.Set("X-Amz-Copy-Source-If-Match", srcInfo.ETag)
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+
+	resp, err := sc.do(ctx, http.MethodPut, dst.bucket, dstKey, nil, header, nil)
+	if err == nil {
+		result := s3CopyObjectResult{}
+		if err = decodeS3Response(resp, &result); err == nil {
+			info := srcInfo
+			info.Bucket = dst.bucket
+			info.Name = dstKey
+			info.ContentType = header.Get("Content-Type")
+			info.StorageClass = header.Get("X-Amz-Storage-Class")
+			if dst.metadata != nil {
+				info.Metadata = dst.metadata
+			}
+			info.ETag = result.ETag
+			info.Generation = etagGeneration(result.ETag)
+			info.MD5 = s3MD5(result.ETag)
+			info.Created = result.LastModified
+			info.Updated = result.LastModified
+			sc.logger.Debug("copied s3 file", zap.String("src", srcKey), zap.String("dst", dstKey))
+			return info, srcInfo, nil
+		}
+	}
+	if isWriteConflict(err) {
+		sc.logger.Error(ERROR_STALE_UPLOAD, zap.Error(err), zap.String("src", srcKey), zap.String("dst", dstKey))
+		return ObjectInfo{}, ObjectInfo{}, kindError(ErrStaleUpload, err)
+	}
+	sc.logger.Error(ERROR_COPYING_OBJECT, zap.Error(err), zap.String("src", srcKey), zap.String("dst", dstKey))
+	return ObjectInfo{}, ObjectInfo{}, wrapStorageError(err, ERROR_COPYING_OBJECT)
+}
+
+// DeleteObject deletes object, S3 deletes succeed for missing keys, so existence is checked first
+func (sc *s3StorageClient) DeleteObject(ctx context.Context, req CloudFileRequest) error {
+	if req.bucket == "" {
+		return ErrBucketNameMissing
+	}
+	if req.path == "" {
+		return ErrFilePathMissing
+	}
+	if req.file == "" {
+		return ErrFileNameMissing
+	}
+	key := req.objectName()
+
+	if _, err := sc.headObject(ctx, req.bucket, key); err != nil {
+		sc.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", key))
+		return wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	resp, err := sc.do(ctx, http.MethodDelete, req.bucket, key, nil, nil, nil)
+	if err != nil {
+		sc.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", key))
+		return wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteObjects deletes objects under request prefix with a bounded worker pool,
+// continues past individual failures & returns incomplete delete error if any object failed
+func (sc *s3StorageClient) DeleteObjects(ctx context.Context, req CloudFileRequest) (DeleteSummary, error) {
+	if err := req.validateList(); err != nil {
+		return DeleteSummary{}, err
+	}
+	// guard against wiping entire bucket
+	if req.path == "" && !req.deleteAll {
+		return DeleteSummary{}, ErrDeletePrefixMissing
+	}
+
+	list, err := sc.ListObjects(ctx, req)
+	if err != nil {
+		return DeleteSummary{}, err
+	}
+
+	summary, err := deleteObjectInfos(ctx, req, feedObjectInfos(list.Objects), sc.deleteListedObject)
+	if err != nil {
+		return summary, err
+	}
+	sc.logger.Info("deleted objects", zap.String("prefix", req.listPrefix()), zap.Bool("dryRun", req.dryRun), zap.Int("deleted", len(summary.Deleted)), zap.Int("failed", len(summary.Failed)))
+	if len(summary.Failed) > 0 {
+		return summary, ErrDeleteIncomplete
+	}
+	return summary, nil
+}
+
+// deleteListedObject deletes listed object, if not replaced since listing, returns delete result
+func (sc *s3StorageClient) deleteListedObject(ctx context.Context, info ObjectInfo) DeleteResult {
+	result := DeleteResult{
+		Key: info.Name,
+	}
+	resp, err := sc.do(ctx, http.MethodDelete, info.Bucket, info.Name, nil, http.Header{"If-Match": {info.ETag}}, nil)
+	switch {
+	case err == nil:
+		resp.Body.Close()
+		sc.logger.Debug("deleted object", zap.String("name", info.Name))
+		result.Status = DeleteStatusDeleted
+	case hasStatus(err, http.StatusNotFound):
+		result.Status = DeleteStatusNotFound
+		result.Err = kindError(ErrObjectNotFound, err)
+	case isPreconditionFailed(err):
+		sc.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", info.Name))
+		result.Status = DeleteStatusPreconditionFailed
+		result.Err = kindError(ErrPreconditionFailed, err)
+	default:
+		sc.logger.Error(ERROR_DELETING_OBJECT, zap.Error(err), zap.String("name", info.Name))
+		result.Status = DeleteStatusFailed
+		result.Err = wrapStorageError(err, ERROR_DELETING_OBJECT)
+	}
+	return result
+}
+
+func (sc *s3StorageClient) Close() error {
+	sc.client.CloseIdleConnections()
+	return nil
+}
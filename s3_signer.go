@@ -0,0 +1,115 @@
+package cloudstorage
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	S3_SIGNING_ALGORITHM = "AWS4-HMAC-SHA256"
+	S3_SERVICE           = "s3"
+	S3_EMPTY_PAYLOAD     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3DateFormat         = "20060102T150405Z"
+)
+
+// S3Credentials are static S3 access credentials, session token is set for temporary credentials
+type S3Credentials struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+}
+
+// s3EnvCredentials returns credentials from AWS environment variables, empty if not set
+func s3EnvCredentials() S3Credentials {
+	creds := S3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" {
+		creds.AccessKeyID = os.Getenv("AWS_ACCESS_KEY")
+	}
+	if creds.SecretAccessKey == "" {
+		creds.SecretAccessKey = os.Getenv("AWS_SECRET_KEY")
+	}
+	return creds
+}
+
+// anonymous checks if credentials are empty, requests are sent unsigned
+func (c S3Credentials) anonymous() bool {
+	return c.AccessKeyID == "" || c.SecretAccessKey == ""
+}
+
+// signS3Request signs request with AWS signature version 4, for given credentials, region & payload hash
+func signS3Request(req *http.Request, creds S3Credentials, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// signed headers, host is not in header map
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		lName := strings.ToLower(name)
+		if strings.HasPrefix(lName, "x-amz-") || lName == "content-type" || lName == "content-md5" || lName == "range" {
+			headers[lName] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, region, S3_SERVICE, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		S3_SIGNING_ALGORITHM,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, S3_SERVICE)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", S3_SIGNING_ALGORITHM+" Credential="+creds.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3CanonicalQuery returns query sorted by key, with keys & values escaped
+func s3CanonicalQuery(query map[string][]string) string {
+	params := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, uriEscape(key, true)+"="+uriEscape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
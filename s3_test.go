@@ -0,0 +1,473 @@
+package cloudstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/comfforts/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3FileStorage(t *testing.T) {
+	runStorageScenarios(t, func(t *testing.T, testCfg *testConfig) (CloudStorage, func()) {
+		return setupS3Test(t, *testCfg, 0)
+	})
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	testCfg := testConfig{
+		dir:    t.TempDir(),
+		bucket: "test-bucket",
+	}
+	client, teardown := setupS3Test(t, testCfg, MIN_S3_PART_SIZE)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), int(2*MIN_S3_PART_SIZE/16)+1024)
+	cfr, err := NewCloudFileRequest(testCfg.bucket, "large.bin", "multipart", 0, WithIfAbsent(), WithMetadata(map[string]string{"owner": "test"}))
+	require.NoError(t, err)
+
+	n, err := client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+
+	info, err := client.StatObject(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size)
+	require.Equal(t, "test", info.Metadata["owner"])
+
+	buf := bytes.Buffer{}
+	_, err = client.DownloadFile(ctx, &buf, cfr)
+	require.NoError(t, err)
+	require.Equal(t, data, buf.Bytes())
+
+	_, err = client.UploadFile(ctx, bytes.NewReader(data), cfr)
+	require.ErrorIs(t, err, ErrStaleUpload)
+
+	missingCfr, err := NewCloudFileRequest("missing-bucket", "large.bin", "multipart", 0)
+	require.NoError(t, err)
+	_, err = client.StatObject(ctx, missingCfr)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestS3ListObjectsOffsets(t *testing.T) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client, err := NewS3StorageClient(S3ClientConfig{
+		Endpoint:  srv.URL,
+		PathStyle: true,
+		Credentials: &S3Credentials{
+			AccessKeyID:     "test",
+			SecretAccessKey: "test-secret",
+		},
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	defer func() {
+		err := client.Close()
+		require.NoError(t, err)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, name := range []string{"a.json", "b.json", "c.json", "c.json.bak", "d.json", "e.json", "f.json", "g.json", "h.json"} {
+		cfr, err := NewCloudFileRequest("test-bucket", name, "offsets", 0)
+		require.NoError(t, err)
+		_, err = client.UploadFile(ctx, bytes.NewReader([]byte("{}")), cfr)
+		require.NoError(t, err)
+	}
+
+	// listing starts at start offset, inclusive, & stops paging at end offset
+	cfr, err := NewCloudFileRequest("test-bucket", "", "offsets", 0, WithStartOffset("offsets/c.json"), WithEndOffset("offsets/e.json"))
+	require.NoError(t, err)
+	names := []string{}
+	pageToken := ""
+	for {
+		page, err := client.ListObjectsPage(ctx, cfr, 2, pageToken)
+		require.NoError(t, err)
+		for _, obj := range page.Objects {
+			names = append(names, obj.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	require.Equal(t, []string{"offsets/c.json", "offsets/c.json.bak", "offsets/d.json"}, names)
+	require.Equal(t, 2, len(fake.lists))
+	require.Equal(t, "offsets/c.jso", fake.lists[0].Get("start-after"))
+
+	fake.lists = nil
+	list, err := client.ListObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(list.Objects))
+	require.Equal(t, 1, len(fake.lists))
+
+	// start-after drops whole last character of multi-byte start offsets
+	fake.lists = nil
+	cfr, err = NewCloudFileRequest("test-bucket", "", "offsets", 0, WithStartOffset("offsets/dé"))
+	require.NoError(t, err)
+	list, err = client.ListObjects(ctx, cfr)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(list.Objects))
+	require.Equal(t, "offsets/e.json", list.Objects[0].Name)
+	require.Equal(t, "offsets/d", fake.lists[0].Get("start-after"))
+}
+
+func TestS3MoveObjectSourceReplaced(t *testing.T) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client, err := NewS3StorageClient(S3ClientConfig{
+		Endpoint:  srv.URL,
+		PathStyle: true,
+		Credentials: &S3Credentials{
+			AccessKeyID:     "test",
+			SecretAccessKey: "test-secret",
+		},
+	}, logger.NewTestAppLogger(t.TempDir()))
+	require.NoError(t, err)
+	defer func() {
+		err := client.Close()
+		require.NoError(t, err)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := NewCloudFileRequest("test-bucket", "a.json", "staging", 0)
+	require.NoError(t, err)
+	dst, err := NewCloudFileRequest("test-bucket", "a.json", "published", 0)
+	require.NoError(t, err)
+	_, err = client.UploadFile(ctx, bytes.NewReader([]byte(`{"v":1}`)), src)
+	require.NoError(t, err)
+
+	// source replaced between copy & source delete
+	fake.afterCopy = func() {
+		fake.objects["test-bucket/staging/a.json"].etag = `"replaced"`
+	}
+	_, err = client.MoveObject(ctx, src, dst)
+	require.ErrorIs(t, err, ErrStaleDownload)
+
+	// copied destination is deleted again, replaced source is kept
+	_, err = client.StatObject(ctx, dst)
+	require.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = client.StatObject(ctx, src)
+	require.NoError(t, err)
+}
+
+func TestNewS3StorageBackend(t *testing.T) {
+	appLogger := logger.NewTestAppLogger(t.TempDir())
+
+	client, err := NewCloudStorage(CloudStorageClientConfig{StorageURL: "s3://localhost:9000?region=eu-west-1&path_style=true&insecure=true"}, appLogger)
+	require.NoError(t, err)
+	sc, ok := client.(*s3StorageClient)
+	require.Equal(t, true, ok)
+	require.Equal(t, "http://localhost:9000", sc.config.Endpoint)
+	require.Equal(t, "eu-west-1", sc.config.Region)
+	require.Equal(t, "http://localhost:9000/bucket/dir/a%20b.json", sc.objectURL("bucket", "dir/a b.json", nil).String())
+
+	_, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "s3://localhost:9000?path_style=maybe"}, appLogger)
+	require.ErrorIs(t, err, ErrInvalidStorageURL)
+
+	client, err = NewCloudStorage(CloudStorageClientConfig{StorageURL: "s3://?region=eu-west-1"}, appLogger)
+	require.NoError(t, err)
+	sc = client.(*s3StorageClient)
+	require.Equal(t, "https://bucket.s3.eu-west-1.amazonaws.com/dir/a.json", sc.objectURL("bucket", "dir/a.json", nil).String())
+
+	// GCS only settings aren't silently ignored
+	for _, cfg := range []CloudStorageClientConfig{
+		{StorageURL: "s3://", CredsPath: "creds/valid-creds.json"},
+		{StorageURL: "s3://", TransferTimeout: time.Minute},
+		{StorageURL: "s3://", Retry: &RetryPolicy{MaxAttempts: 1}},
+		{StorageURL: "s3://", ChunkSize: EightMB},
+	} {
+		_, err = NewCloudStorage(cfg, appLogger)
+		require.ErrorIs(t, err, ErrUnsupportedConfig)
+	}
+}
+
+func setupS3Test(t *testing.T, testCfg testConfig, partSize int64) (
+	client CloudStorage,
+	teardown func(),
+) {
+	t.Helper()
+
+	srv := httptest.NewServer(newFakeS3())
+	client, err := NewS3StorageClient(S3ClientConfig{
+		Endpoint:  srv.URL,
+		PathStyle: true,
+		Credentials: &S3Credentials{
+			AccessKeyID:     "test",
+			SecretAccessKey: "test-secret",
+		},
+		PartSize: partSize,
+	}, logger.NewTestAppLogger(testCfg.dir))
+	require.NoError(t, err)
+
+	return client, func() {
+		err := client.Close()
+		require.NoError(t, err)
+		srv.Close()
+	}
+}
+
+type fakeS3Object struct {
+	data     []byte
+	etag     string
+	header   http.Header
+	modified time.Time
+}
+
+// fakeS3 is a path style S3 stand-in, keeping objects in memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	seq     int
+	objects map[string]*fakeS3Object
+	uploads map[string]map[int][]byte
+	headers map[string]http.Header
+	lists   []url.Values
+	// afterCopy, when set, is called with fake locked once a copy succeeds
+	afterCopy func()
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: map[string]*fakeS3Object{},
+		uploads: map[string]map[int][]byte{},
+		headers: map[string]http.Header{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), S3_SIGNING_ALGORITHM+" Credential=test/") {
+		fakeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, bucket, query)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		f.get(w, r, bucket+"/"+key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		partNum, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][partNum] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		srcPath, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		src := f.objects[strings.TrimPrefix(srcPath, "/")]
+		if src == nil {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if r.Header.Get("X-Amz-Copy-Source-If-Match") != src.etag {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		obj, ok := f.put(w, r, bucket+"/"+key, src.data)
+		if ok {
+			if f.afterCopy != nil {
+				f.afterCopy()
+			}
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>", obj.etag, obj.modified.Format(time.RFC3339))
+		}
+	case r.Method == http.MethodPut:
+		f.put(w, r, bucket+"/"+key, body)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.seq++
+		uploadID := strconv.Itoa(f.seq)
+		f.uploads[uploadID] = map[int][]byte{}
+		f.headers[uploadID] = r.Header.Clone()
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		uploadID := query.Get("uploadId")
+		complete := s3CompleteMultipartUpload{}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for _, part := range complete.Parts {
+			data = append(data, f.uploads[uploadID][part.PartNumber]...)
+		}
+		req := r.Clone(r.Context())
+		for name, values := range f.headers[uploadID] {
+			if _, ok := req.Header[name]; !ok {
+				req.Header[name] = values
+			}
+		}
+		obj, ok := f.put(w, req, bucket+"/"+key, data)
+		if ok {
+			delete(f.uploads, uploadID)
+			fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", obj.etag)
+		}
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		obj := f.objects[bucket+"/"+key]
+		if obj != nil && r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != obj.etag {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// put stores object if write conditions hold, entity tags are unique per write
+func (f *fakeS3) put(w http.ResponseWriter, r *http.Request, name string, data []byte) (*fakeS3Object, bool) {
+	current := f.objects[name]
+	if r.Header.Get("If-None-Match") == "*" && current != nil {
+		fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return nil, false
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (current == nil || current.etag != ifMatch) {
+		fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return nil, false
+	}
+
+	f.seq++
+	obj := &fakeS3Object{
+		data:     data,
+		etag:     fmt.Sprintf(`"%x"`, md5.Sum(append([]byte(strconv.Itoa(f.seq)), data...))),
+		header:   http.Header{},
+		modified: time.Now().UTC(),
+	}
+	for name, values := range r.Header {
+		if name == "Content-Type" || name == "Content-Encoding" || name == "X-Amz-Storage-Class" || strings.HasPrefix(name, s3MetaHeaderPrefix) {
+			obj.header[name] = values
+		}
+	}
+	f.objects[name] = obj
+	w.Header().Set("ETag", obj.etag)
+	return obj, true
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, name string) {
+	obj := f.objects[name]
+	if obj == nil {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != obj.etag {
+		fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	for name, values := range obj.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+
+	data, status := obj.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, _ := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+		off, _ := strconv.Atoi(start)
+		if off >= len(data) {
+			fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		last := len(data) - 1
+		if end != "" {
+			if l, _ := strconv.Atoi(end); l < last {
+				last = l
+			}
+		}
+		data, status = data[off:last+1], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := 1000
+	if mk := query.Get("max-keys"); mk != "" {
+		maxKeys, _ = strconv.Atoi(mk)
+	}
+	f.lists = append(f.lists, query)
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		name, _ := base64.RawURLEncoding.DecodeString(token)
+		after = string(name)
+	}
+
+	keys := []string{}
+	for name := range f.objects {
+		if key := strings.TrimPrefix(name, bucket+"/"); key != name && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := bytes.Buffer{}
+	seen := map[string]bool{}
+	cnt, last, truncated := 0, "", false
+	for _, key := range keys {
+		entry := key
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				entry = key[:len(prefix)+idx+len(delimiter)]
+			}
+		}
+		if entry <= after || seen[entry] {
+			continue
+		}
+		if cnt == maxKeys {
+			truncated = true
+			break
+		}
+		seen[entry], cnt, last = true, cnt+1, entry
+
+		if entry != key {
+			fmt.Fprintf(&result, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", entry)
+			continue
+		}
+		obj := f.objects[bucket+"/"+key]
+		fmt.Fprintf(&result, "<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>",
+			key, obj.modified.Format(time.RFC3339), obj.etag, len(obj.data))
+	}
+	fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", base64.RawURLEncoding.EncodeToString([]byte(last)))
+	}
+	w.Write(result.Bytes())
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}